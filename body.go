@@ -0,0 +1,157 @@
+package buffon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"sort"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+var (
+	errFormBody  = errors.New("Form body must be an object")
+	errFormValue = errors.New("Form values must be scalars or arrays of scalars")
+)
+
+type multipartBody struct {
+	Fields map[string]string `json:"fields"`
+	Files  []multipartFile   `json:"files"`
+}
+
+type multipartFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+func encodeBody(contentType string, v interface{}) ([]byte, string, error) {
+	if contentType == "" {
+		return encodeJSON(v), "", nil
+	}
+
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return encodeJSON(v), contentType, nil
+	}
+
+	switch t {
+	case "application/x-www-form-urlencoded":
+		b, err := encodeForm(v)
+		return b, contentType, err
+	case "multipart/form-data":
+		return encodeMultipart(v)
+	}
+
+	return encodeJSON(v), contentType, nil
+}
+
+func encodeJSON(v interface{}) []byte {
+	if v == nil {
+		return nil
+	}
+
+	b, _ := json.Marshal(v)
+	return bytes.TrimSuffix(b, []byte("\n"))
+}
+
+func encodeForm(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok && v != nil {
+		return nil, errFormBody
+	}
+
+	q := make(url.Values)
+
+	for k, z := range m {
+		zs, ok := z.([]interface{})
+		if !ok {
+			zs = []interface{}{z}
+		}
+
+		for _, s := range zs {
+			s, ok := formValue(s)
+			if !ok {
+				return nil, errFormValue
+			}
+
+			q.Add(k, s)
+		}
+	}
+
+	return []byte(q.Encode()), nil
+}
+
+func formValue(v interface{}) (string, bool) {
+	switch z := v.(type) {
+	case nil:
+		return "", true
+	case map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(z), true
+	}
+}
+
+func encodeMultipart(v interface{}) ([]byte, string, error) {
+	z := multipartBody{}
+
+	if b := encodeJSON(v); b != nil {
+		if err := json.Unmarshal(b, &z); err != nil {
+			return nil, "", err
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	w := multipart.NewWriter(buf)
+
+	ks := make([]string, 0, len(z.Fields))
+
+	for k := range z.Fields {
+		ks = append(ks, k)
+	}
+
+	sort.Strings(ks)
+
+	for _, k := range ks {
+		if err := w.WriteField(k, z.Fields[k]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, f := range z.Files {
+		b, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, "", err
+		}
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, f.Field, f.Filename))
+		h.Set("Content-Type", f.ContentType)
+
+		if f.ContentType == "" {
+			h.Set("Content-Type", "application/octet-stream")
+		}
+
+		p, err := w.CreatePart(h)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if _, err := p.Write(b); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
@@ -1,9 +1,19 @@
 package buffon
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
+var errOverloaded = errors.New("Too many concurrent aggregate requests")
+
+type aggregateIDKey struct{}
+
 type Executor interface {
 	Build(r *http.Request) (map[string]*http.Request, error)
 	Fetch(mr map[string]*http.Request) (map[string]*http.Response, error)
@@ -11,21 +21,124 @@ type Executor interface {
 	FinishErr(w http.ResponseWriter, code int, err error)
 }
 
+type Builder interface {
+	Build(r *http.Request) (map[string]*http.Request, error)
+}
+
+type Fetcher interface {
+	Fetch(mr map[string]*http.Request, htc *http.Client) (map[string]*http.Response, error)
+}
+
+type Finisher interface {
+	Finish(w http.ResponseWriter, mr map[string]*http.Response, err error)
+	FinishErr(w http.ResponseWriter, code int, err error)
+}
+
+type Middleware func(Executor) Executor
+
 type Aggregator struct {
-	C Executor
+	C           Executor
+	Ready       func() bool
+	Nonce       NonceStore
+	NonceWindow time.Duration
+	MaxInflight int
+	inflight    int32
+	drain       drain
 }
 
 func NewAggregator(c Executor) *Aggregator {
 	return &Aggregator{C: c}
 }
 
+func (a *Aggregator) Use(ms ...Middleware) {
+	for i := len(ms) - 1; i >= 0; i-- {
+		a.C = ms[i](a.C)
+	}
+}
+
 func (a *Aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := aggregateID(r)
+	r = r.WithContext(context.WithValue(r.Context(), aggregateIDKey{}, id))
+	w.Header().Set("X-Aggregate-Id", id)
+
+	if !a.drain.enter() {
+		a.C.FinishErr(w, http.StatusServiceUnavailable, errShuttingDown)
+		return
+	}
+
+	defer a.drain.leave()
+
+	n := atomic.AddInt32(&a.inflight, 1)
+	defer atomic.AddInt32(&a.inflight, -1)
+
+	if a.MaxInflight > 0 && int(n) > a.MaxInflight {
+		a.C.FinishErr(w, http.StatusServiceUnavailable, errOverloaded)
+		return
+	}
+
+	if a.Ready != nil && !a.Ready() {
+		a.C.FinishErr(w, http.StatusServiceUnavailable, errNotReady)
+		return
+	}
+
+	if a.Nonce != nil {
+		if err := checkNonce(a.Nonce, a.NonceWindow, r); err != nil {
+			a.C.FinishErr(w, a.errStatusCode(err), err)
+			return
+		}
+	}
+
 	mr, err := a.C.Build(r)
 	if err != nil {
-		a.C.FinishErr(w, http.StatusBadRequest, err)
+		a.C.FinishErr(w, a.errStatusCode(err), err)
 		return
 	}
 
 	ms, es := a.C.Fetch(mr)
 	a.C.Finish(w, ms, es)
 }
+
+func (a *Aggregator) Shutdown(ctx context.Context) error {
+	if err := a.drain.shutdown(ctx); err != nil {
+		return err
+	}
+
+	if c, ok := a.C.(shutdowner); ok {
+		return c.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+func (a *Aggregator) Inflight() int {
+	return int(atomic.LoadInt32(&a.inflight))
+}
+
+func AggregateID(ctx context.Context) string {
+	s, _ := ctx.Value(aggregateIDKey{}).(string)
+	return s
+}
+
+func aggregateID(r *http.Request) string {
+	if s := r.Header.Get("X-Aggregate-Id"); s != "" {
+		return s
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func (a *Aggregator) errStatusCode(err error) int {
+	switch err := err.(type) {
+	case Error:
+		if err.StatusCode != 0 {
+			return err.StatusCode
+		}
+	case filterError:
+		return http.StatusUnprocessableEntity
+	}
+
+	return http.StatusBadRequest
+}
@@ -0,0 +1,11 @@
+module github.com/bukalapak/buffon/buffonprom
+
+go 1.12
+
+require (
+	github.com/bukalapak/buffon v1.1.0
+	github.com/prometheus/client_golang v1.7.0
+	github.com/stretchr/testify v1.4.0
+)
+
+replace github.com/bukalapak/buffon => ../
@@ -0,0 +1,73 @@
+package buffonprom
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "buffon"
+
+var labels = []string{"method", "route", "status"}
+
+type Metrics struct {
+	FetchDuration *prometheus.HistogramVec
+	FetchTotal    *prometheus.CounterVec
+	FetchErrors   *prometheus.CounterVec
+	gatherer      prometheus.Gatherer
+}
+
+func New(reg *prometheus.Registry) (*Metrics, error) {
+	var r prometheus.Registerer = prometheus.DefaultRegisterer
+	var g prometheus.Gatherer = prometheus.DefaultGatherer
+
+	if reg != nil {
+		r, g = reg, reg
+	}
+
+	m := &Metrics{
+		FetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "fetch_duration_seconds",
+			Help:      "Duration of backend sub-requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		FetchTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_total",
+			Help:      "Number of backend sub-requests.",
+		}, labels),
+		FetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "fetch_errors_total",
+			Help:      "Number of failed backend sub-requests by error class.",
+		}, []string{"method", "route", "class"}),
+		gatherer: g,
+	}
+
+	for _, c := range []prometheus.Collector{m.FetchDuration, m.FetchTotal, m.FetchErrors} {
+		if err := r.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Metrics) FetchLatency(n time.Duration, method, routePattern string, statusCode int) {
+	status := strconv.Itoa(statusCode)
+
+	m.FetchDuration.WithLabelValues(method, routePattern, status).Observe(n.Seconds())
+	m.FetchTotal.WithLabelValues(method, routePattern, status).Inc()
+}
+
+func (m *Metrics) FetchError(n time.Duration, method, routePattern, class string) {
+	m.FetchErrors.WithLabelValues(method, routePattern, class).Inc()
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.gatherer, promhttp.HandlerOpts{})
+}
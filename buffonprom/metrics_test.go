@@ -0,0 +1,69 @@
+package buffonprom_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bukalapak/buffon"
+	"github.com/bukalapak/buffon/buffonprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Route-Pattern", "/users/:id")
+		w.Write([]byte(`{"data":{"id":1}}`))
+	}))
+	defer backend.Close()
+
+	m, err := buffonprom.New(prometheus.NewRegistry())
+	assert.Nil(t, err)
+
+	opt := &buffon.DefaultOption{
+		FetchLatency: m.FetchLatency,
+		FetchLogger:  func(n time.Duration, method, urlPath string, statusCode int, reqID string) {},
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/users/1"},"x2":{"path":"/users/2"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, w.Body.String(), `buffon_fetch_total{method="GET",route="/users/:id",status="200"} 2`)
+	assert.Contains(t, w.Body.String(), `buffon_fetch_duration_seconds_count{method="GET",route="/users/:id",status="200"} 2`)
+}
+
+func TestMetrics_FetchError(t *testing.T) {
+	m, err := buffonprom.New(prometheus.NewRegistry())
+	assert.Nil(t, err)
+
+	m.FetchError(time.Second, "GET", "", "dns")
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, w.Body.String(), `buffon_fetch_errors_total{class="dns",method="GET",route=""} 1`)
+}
+
+func TestMetrics_Duplicate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	_, err := buffonprom.New(reg)
+	assert.Nil(t, err)
+
+	_, err = buffonprom.New(reg)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,227 @@
+package buffon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	mu      *sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func NewMemoryCache() Cache {
+	return &memoryCache{
+		mu:      &sync.Mutex{},
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return e.value, true
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+type cacheHint struct {
+	Key string `json:"key"`
+	TTL int    `json:"ttl"`
+}
+
+func cacheKey(mr map[string]*http.Request) string {
+	ks := make([]string, 0, len(mr))
+
+	for k := range mr {
+		ks = append(ks, k)
+	}
+
+	sort.Strings(ks)
+
+	h := sha256.New()
+
+	for _, k := range ks {
+		r := mr[k]
+
+		h.Write([]byte(k + "\n" + r.Method + " " + r.URL.RequestURI() + "\n"))
+
+		if r.GetBody != nil {
+			if body, err := r.GetBody(); err == nil {
+				b, _ := ioutil.ReadAll(body)
+				h.Write(b)
+			}
+		}
+
+		h.Write([]byte("\n"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func maxAge(h http.Header) time.Duration {
+	var n time.Duration
+
+	for _, s := range strings.Split(h.Get("Cache-Control"), ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+
+		switch {
+		case s == "no-store" || s == "no-cache":
+			return 0
+		case strings.HasPrefix(s, "max-age="):
+			v, err := strconv.Atoi(s[len("max-age="):])
+			if err != nil || v < 0 {
+				return 0
+			}
+
+			n = time.Duration(v) * time.Second
+		}
+	}
+
+	return n
+}
+
+func isCacheable(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == ""
+}
+
+func noCache(r *http.Request) bool {
+	for _, s := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.ToLower(strings.TrimSpace(s)) == "no-cache" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func responseKey(r *http.Request, vary []string) string {
+	s := r.Method + " " + r.URL.String()
+
+	hs := append(append([]string(nil), subRequestOf(r).keyHeaders...), vary...)
+	sort.Strings(hs)
+
+	for _, k := range hs {
+		s += "\n" + k + ": " + strings.Join(r.Header[http.CanonicalHeaderKey(k)], ", ")
+	}
+
+	return s
+}
+
+func varyKey(r *http.Request) string {
+	return "vary " + r.Method + " " + r.URL.String()
+}
+
+func varyHeaders(h http.Header) ([]string, bool) {
+	var ks []string
+
+	for _, v := range h["Vary"] {
+		for _, s := range strings.Split(v, ",") {
+			s = strings.TrimSpace(s)
+
+			switch s {
+			case "":
+			case "*":
+				return nil, false
+			default:
+				ks = append(ks, http.CanonicalHeaderKey(s))
+			}
+		}
+	}
+
+	return ks, true
+}
+
+func sharedMaxAge(h http.Header) time.Duration {
+	for _, s := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.ToLower(strings.TrimSpace(s)) == "private" {
+			return 0
+		}
+	}
+
+	return maxAge(h)
+}
+
+func cachedResponse(c Cache, r *http.Request) (*http.Response, bool) {
+	v, ok := c.Get(varyKey(r))
+	if !ok {
+		return nil, false
+	}
+
+	var vary []string
+
+	if len(v) != 0 {
+		vary = strings.Split(string(v), ",")
+	}
+
+	b, ok := c.Get(responseKey(r, vary))
+	if !ok {
+		return nil, false
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), r)
+	if err != nil {
+		return nil, false
+	}
+
+	return res, true
+}
+
+func storeResponse(c Cache, r *http.Request, res *http.Response) {
+	if res.StatusCode != http.StatusOK {
+		return
+	}
+
+	ttl := sharedMaxAge(res.Header)
+	if ttl == 0 {
+		return
+	}
+
+	vary, ok := varyHeaders(res.Header)
+	if !ok {
+		return
+	}
+
+	b, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return
+	}
+
+	c.Set(varyKey(r), []byte(strings.Join(vary, ",")), ttl)
+	c.Set(responseKey(r, vary), b, ttl)
+}
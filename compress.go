@@ -0,0 +1,66 @@
+package buffon
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"strconv"
+	"strings"
+)
+
+func acceptedEncoding(accept string) string {
+	var enc string
+	var best float64
+
+	for _, s := range strings.Split(accept, ",") {
+		ps := strings.Split(s, ";")
+		name := strings.ToLower(strings.TrimSpace(ps[0]))
+		q := 1.0
+
+		for _, p := range ps[1:] {
+			p = strings.TrimSpace(p)
+
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+
+		if q > best {
+			enc, best = name, q
+		}
+	}
+
+	return enc
+}
+
+func compress(enc string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+
+	switch enc {
+	case "gzip":
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(b); err == nil {
+			err = w.Close()
+		}
+	case "deflate":
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		if _, err = w.Write(b); err == nil {
+			err = w.Close()
+		}
+	default:
+		return b, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
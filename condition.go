@@ -0,0 +1,269 @@
+package buffon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+var (
+	errInvalidCondition = errors.New("Invalid condition")
+	errCyclicCondition  = errors.New("Conditions must not form a cycle")
+)
+
+type condition struct {
+	Key   string
+	Path  []string
+	Op    string
+	Value interface{}
+}
+
+func parseCondition(s string) (condition, error) {
+	c := condition{}
+	expr := s
+	at := -1
+
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(s, op); i >= 0 && (at < 0 || i < at) {
+			at = i
+			c.Op = op
+		}
+	}
+
+	if at >= 0 {
+		expr = s[:at]
+
+		if err := json.Unmarshal([]byte(strings.TrimSpace(s[at+len(c.Op):])), &c.Value); err != nil {
+			return c, errInvalidCondition
+		}
+	}
+
+	ss := strings.Split(strings.TrimSpace(expr), ".")
+
+	for _, z := range ss {
+		if z == "" {
+			return c, errInvalidCondition
+		}
+	}
+
+	c.Key = ss[0]
+	c.Path = ss[1:]
+
+	return c, nil
+}
+
+func (c condition) Eval(b []byte) bool {
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return false
+	}
+
+	v, ok := lookupPath(v, c.Path)
+
+	switch c.Op {
+	case "==":
+		return ok && reflect.DeepEqual(v, c.Value)
+	case "!=":
+		return !ok || !reflect.DeepEqual(v, c.Value)
+	}
+
+	return ok && truthy(v)
+}
+
+func lookupPath(v interface{}, path []string) (interface{}, bool) {
+	for _, s := range path {
+		switch z := v.(type) {
+		case map[string]interface{}:
+			n, ok := z[s]
+			if !ok {
+				return nil, false
+			}
+
+			v = n
+		case []interface{}:
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 || i >= len(z) {
+				return nil, false
+			}
+
+			v = z[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func truthy(v interface{}) bool {
+	switch z := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return z
+	case float64:
+		return z != 0
+	case string:
+		return z != ""
+	case []interface{}:
+		return len(z) != 0
+	case map[string]interface{}:
+		return len(z) != 0
+	}
+
+	return true
+}
+
+func requestCondition(r *http.Request) (condition, bool) {
+	s := subRequestOf(r).cond
+	if s == "" {
+		return condition{}, false
+	}
+
+	c, err := parseCondition(s)
+	return c, err == nil
+}
+
+func hasConditionCycle(mr map[string]*http.Request) bool {
+	state := make(map[string]int)
+
+	var visit func(k string) bool
+
+	visit = func(k string) bool {
+		switch state[k] {
+		case 1:
+			return true
+		case 2:
+			return false
+		}
+
+		state[k] = 1
+
+		if r, ok := mr[k]; ok {
+			if c, ok := requestCondition(r); ok && visit(c.Key) {
+				return true
+			}
+		}
+
+		state[k] = 2
+		return false
+	}
+
+	for k := range mr {
+		if visit(k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type dependencies struct {
+	mu     *sync.Mutex
+	done   map[string]chan struct{}
+	refs   map[string]bool
+	bodies map[string][]byte
+}
+
+func newDependencies(mr map[string]*http.Request) *dependencies {
+	d := &dependencies{
+		mu:     &sync.Mutex{},
+		done:   make(map[string]chan struct{}),
+		refs:   make(map[string]bool),
+		bodies: make(map[string][]byte),
+	}
+
+	for k, r := range mr {
+		d.done[k] = make(chan struct{})
+
+		if c, ok := requestCondition(r); ok {
+			d.refs[c.Key] = true
+		}
+	}
+
+	return d
+}
+
+func (d *dependencies) Wait(r *http.Request) bool {
+	if subRequestOf(r).cond == "" {
+		return true
+	}
+
+	c, ok := requestCondition(r)
+	if !ok {
+		return true
+	}
+
+	ch, ok := d.done[c.Key]
+	if !ok {
+		return false
+	}
+
+	<-ch
+
+	d.mu.Lock()
+	b, ok := d.bodies[c.Key]
+	d.mu.Unlock()
+
+	return ok && c.Eval(b)
+}
+
+func (d *dependencies) Done(k string, res *http.Response) {
+	defer close(d.done[k])
+
+	if !d.refs[k] || res == nil {
+		return
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	if err != nil || !expectedStatus(res) {
+		return
+	}
+
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+
+		if b, err = ioutil.ReadAll(gz); err != nil {
+			return
+		}
+	}
+
+	d.mu.Lock()
+	d.bodies[k] = b
+	d.mu.Unlock()
+}
+
+func skippedResponse(r *http.Request) *http.Response {
+	subRequestOf(r).skipped = true
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Request:       r,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader("{}")),
+		ContentLength: 2,
+	}
+}
+
+func aggregateSkipped(r *http.Request) bool {
+	return subRequestOf(r).skipped
+}
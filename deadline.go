@@ -0,0 +1,60 @@
+package buffon
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var grpcUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+func upstreamDeadline(r *http.Request, name string, now time.Time) (time.Duration, bool) {
+	s := strings.TrimSpace(r.Header.Get(name))
+	if s == "" {
+		return 0, false
+	}
+
+	if http.CanonicalHeaderKey(name) == "Grpc-Timeout" {
+		return parseGRPCTimeout(s)
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Sub(now), true
+	}
+
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, true
+	}
+
+	if n, err := time.ParseDuration(s); err == nil {
+		return n, true
+	}
+
+	return 0, false
+}
+
+func parseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, false
+	}
+
+	unit, ok := grpcUnits[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
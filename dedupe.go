@@ -0,0 +1,125 @@
+package buffon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type flight struct {
+	wg   sync.WaitGroup
+	res  *http.Response
+	body []byte
+	err  error
+}
+
+type flightGroup struct {
+	mu *sync.Mutex
+	m  map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{mu: &sync.Mutex{}, m: make(map[string]*flight)}
+}
+
+func (g *flightGroup) Do(r *http.Request, fn func() (*http.Response, error)) (*http.Response, error) {
+	key := subRequestOf(r).dedupe
+	if key == "" {
+		return fn()
+	}
+
+	g.mu.Lock()
+
+	if f, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+
+		return f.share(r)
+	}
+
+	f := &flight{}
+	f.wg.Add(1)
+	g.m[key] = f
+	g.mu.Unlock()
+
+	defer f.wg.Done()
+
+	f.res, f.err = fn()
+
+	if f.err == nil {
+		f.body, f.err = ioutil.ReadAll(f.res.Body)
+		f.res.Body.Close()
+	}
+
+	return f.share(r)
+}
+
+func (f *flight) share(r *http.Request) (*http.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	if f.res == nil {
+		return nil, errInternalPanic
+	}
+
+	res := *f.res
+	res.Request = r
+	res.Header = cloneHeader(f.res.Header)
+	res.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+
+	return &res, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	z := make(http.Header, len(h))
+
+	for k, vs := range h {
+		z[k] = append([]string(nil), vs...)
+	}
+
+	return z
+}
+
+func dedupeKey(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return ""
+	}
+
+	if r.Header.Get("X-Invalid") != "" {
+		return ""
+	}
+
+	ks := make([]string, 0, len(r.Header))
+
+	for k := range r.Header {
+		if !internalHeader(k) {
+			ks = append(ks, k)
+		}
+	}
+
+	sort.Strings(ks)
+
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.String() + "\n"))
+
+	for _, k := range ks {
+		h.Write([]byte(k + ": " + strings.Join(r.Header[k], ",") + "\n"))
+	}
+
+	if r.GetBody != nil {
+		if body, err := r.GetBody(); err == nil {
+			b, _ := ioutil.ReadAll(body)
+			h.Write(b)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -1,36 +1,192 @@
 package buffon
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bukalapak/ottoman/encoding/json"
 	httpclone "github.com/bukalapak/ottoman/http/clone"
 )
 
+const (
+	defaultMaxPathLength = 4096
+	defaultMaxQueryBytes = 8192
+)
+
+var invalidMessages = map[string]string{
+	"path": "Invalid path",
+	"host": "Host not allowed",
+	"body": "Invalid body",
+}
+
 var (
 	errUnsupportedMedia = errors.New(http.StatusText(http.StatusUnsupportedMediaType))
 	errMissedQuery      = errors.New("Must provide aggregate query")
 	errTooManyRequests  = errors.New("Too many aggregate requests")
+	errEmptyAggregate   = errors.New("Aggregate must not be empty")
+	errTimeoutBudget    = errors.New("Aggregate exceeds the timeout budget")
+	errDuplicateKey     = errors.New("Duplicate aggregate key")
+	errDuplicateOutput  = errors.New("Duplicate aggregate output key")
+	errMergeTarget      = errors.New("Merge target conflicts with aggregate key")
+	errInvalidPath      = errors.New("Invalid path")
+	errUnknownService   = errors.New("Unknown service")
+	errPlaintextBackend = errors.New("Backend must use HTTPS")
+	errUnknownKey       = errors.New("Unknown aggregate key")
+	errSkippedKey       = errors.New("Aggregate key was skipped")
+	errInvalidKey       = errors.New("Invalid aggregate key")
+	errMethodNotAllowed = errors.New(http.StatusText(http.StatusMethodNotAllowed))
+	errHeaderOverride   = errors.New("Original header overrides a forwarded header")
+	errURITooLong       = errors.New("URI too long")
+	errDeadlineExceeded = Error{Message: "Upstream deadline exceeded", StatusCode: http.StatusGatewayTimeout}
+	errRequestTooLarge  = Error{Message: "Aggregate request is too large", StatusCode: http.StatusRequestEntityTooLarge}
+	errInternalPanic    = errors.New("Sub-request panicked")
+)
+
+type errDeadline struct {
+	name string
+	n    time.Duration
+}
+
+func (e errDeadline) Error() string {
+	return e.name + " of " + e.n.String() + " exceeded"
+}
+
+type echoHeadersKey struct{}
+
+type acceptKey struct{}
+
+type acceptEncodingKey struct{}
+
+type EmptySection int
+
+const (
+	SectionObject EmptySection = iota
+	SectionNull
+	SectionOmit
+)
+
+type MessageMode int
+
+const (
+	MessageDefault MessageMode = iota
+	MessageAlways
+	MessageOmit
+	MessageOnError
+)
+
+type OutputMode int
+
+const (
+	OutputKeyed OutputMode = iota
+	OutputArray
+	OutputMerged
 )
 
 type DefaultOption struct {
-	Transport    http.RoundTripper
-	Timeout      time.Duration
-	MaxTimeout   time.Duration
-	MaxRequest   int
-	FetchLatency func(n time.Duration, method, routePattern string, statusCode int)
-	FetchLogger  func(n time.Duration, method, urlPath string, statusCode int, reqID string)
+	Transport          http.RoundTripper
+	Timeout            time.Duration
+	MaxTimeout         time.Duration
+	MaxRequest         int
+	MaxRequestBytes    int64
+	Output             OutputMode
+	ResponseHeaderMeta []string
+	StatusPolicy       StatusPolicy
+	MaxRetry           int
+	RetryBudget        int
+	Tracer             Tracer
+	Warnings           bool
+	TransformResponse  func(key string, body []byte) ([]byte, error)
+	TTFBTimeout        time.Duration
+	ConnectTimeout     time.Duration
+	DeprecationMeta    bool
+	Filters            []Filter
+	OnEmpty            EmptyMode
+	PathRewrites       []Rewrite
+	ErrCodeFor         func(statusCode int, timeout bool) int
+	EchoHeaders        func(r *http.Request) bool
+	DryRun             bool
+	CacheHint          bool
+	ForwardedFor       bool
+	TrustedProxies     []*net.IPNet
+	PingPath           string
+	EmptySections      EmptySection
+	FetchLatency       func(n time.Duration, method, routePattern string, statusCode int)
+	FetchError         func(n time.Duration, method, routePattern, class string)
+	FetchLogger        func(n time.Duration, method, urlPath string, statusCode int, reqID string)
+	RequestLogger      func(r *http.Request, n time.Duration, statusCode int)
+	AggregateLatency   func(total time.Duration, count, failed int)
+	InvalidPathError   bool
+	SLOThreshold       time.Duration
+	SLOThresholds      map[string]time.Duration
+	SLOBreach          func(n time.Duration, method, routePattern string)
+	SLOMeta            bool
+	StripHeaders       []string
+	Services           map[string]*url.URL
+	HTTPSOnly          bool
+	MaxPartBytes       int64
+	UserAgent          string
+	TimeoutJitter      float64
+	Cache              Cache
+	KeyPattern         *regexp.Regexp
+	Passthrough        bool
+	AllowedMethods     []string
+	Compress           bool
+	CompressMinBytes   int
+	ErrorBodyBytes     int
+	PanicLogger        func(key string, v interface{}, stack []byte)
+	Atomic             bool
+	Envelope           Envelope
+	SignRequest        func(r *http.Request)
+	MaxConcurrency     int
+	WorkerPool         int
+	RejectEmpty        bool
+	Summary            bool
+	FinalizeResponse   func(b []byte) []byte
+	SortKeys           bool
+	MaxTimeoutBudget   time.Duration
+	UniformErrors      bool
+	Dedupe             bool
+	SlowThreshold      time.Duration
+	Builder            Builder
+	Fetcher            Fetcher
+	Finisher           Finisher
+	OriginalHeaders    []string
+	RejectOverride     bool
+	OverrideLogger     func(r *http.Request, name string)
+	Messages           MessageMode
+	MaxPathLength      int
+	MaxQueryBytes      int
+	DeadlineHeader     string
+	ContextHeaders     map[interface{}]string
+	StrictEnvelope     bool
+	SniffGzip          bool
+	Mocks              map[string]Mock
+	ValidateBody       func(key string, n *json.Node) error
+	ErrorRateWindow    time.Duration
 }
 
 type DefaultExecutor struct {
@@ -38,6 +194,8 @@ type DefaultExecutor struct {
 	builder  *defaultBuilder
 	fetcher  *defaultFetcher
 	finisher *defaultFinisher
+	client   *http.Client
+	drain    drain
 }
 
 func NewDefaultExecutor(s string, opt *DefaultOption) (*DefaultExecutor, error) {
@@ -46,40 +204,237 @@ func NewDefaultExecutor(s string, opt *DefaultOption) (*DefaultExecutor, error)
 		return nil, err
 	}
 
+	if err := checkScheme(opt, u); err != nil {
+		return nil, err
+	}
+
 	v := &defaultBuilder{
-		BaseURL:        u,
-		DefaultTimeout: opt.Timeout,
-		MaxTimeout:     opt.MaxTimeout,
-		MaxRequest:     opt.MaxRequest,
+		BaseURL:         u,
+		DefaultTimeout:  opt.Timeout,
+		MaxTimeout:      opt.MaxTimeout,
+		TTFBTimeout:     opt.TTFBTimeout,
+		ConnectTimeout:  opt.ConnectTimeout,
+		MaxRequest:      opt.MaxRequest,
+		MaxRequestBytes: opt.MaxRequestBytes,
+		Warnings:        opt.Warnings,
+		Filters:         opt.Filters,
+		OnEmpty:         opt.OnEmpty,
+		PathRewrites:    opt.PathRewrites,
+		EchoHeaders:     opt.EchoHeaders,
+		CacheHint:       opt.CacheHint,
+		ForwardedFor:    opt.ForwardedFor,
+		TrustedProxies:  opt.TrustedProxies,
+		StripHeaders:    opt.StripHeaders,
+		Services:        opt.Services,
+		HTTPSOnly:       opt.HTTPSOnly,
+		MaxPartBytes:    opt.MaxPartBytes,
+		UserAgent:       opt.UserAgent,
+		TimeoutJitter:   opt.TimeoutJitter,
+		KeyPattern:      opt.KeyPattern,
+		AllowedMethods:  opt.AllowedMethods,
+		SignRequest:     opt.SignRequest,
+		RejectEmpty:     opt.RejectEmpty,
+		TimeoutBudget:   opt.MaxTimeoutBudget,
+		Dedupe:          opt.Dedupe,
+		OriginalHeaders: opt.OriginalHeaders,
+		RejectOverride:  opt.RejectOverride,
+		OverrideLogger:  opt.OverrideLogger,
+		MaxPathLength:   opt.MaxPathLength,
+		MaxQueryBytes:   opt.MaxQueryBytes,
+		DeadlineHeader:  opt.DeadlineHeader,
+		ContextHeaders:  opt.ContextHeaders,
+		StrictEnvelope:  opt.StrictEnvelope,
 	}
 
-	return &DefaultExecutor{
+	c := &DefaultExecutor{
 		option:  opt,
 		builder: v,
 		fetcher: &defaultFetcher{
-			FetchLatency: opt.FetchLatency,
-			FetchLogger:  opt.FetchLogger,
+			MaxRetry:         opt.MaxRetry,
+			RetryBudget:      opt.RetryBudget,
+			Tracer:           opt.Tracer,
+			ErrCodeFor:       opt.ErrCodeFor,
+			DryRun:           opt.DryRun,
+			FetchLatency:     opt.FetchLatency,
+			FetchError:       opt.FetchError,
+			FetchLogger:      opt.FetchLogger,
+			RequestLogger:    opt.RequestLogger,
+			AggregateLatency: opt.AggregateLatency,
+			InvalidPathError: opt.InvalidPathError,
+			Cache:            opt.Cache,
+			SLOThreshold:     opt.SLOThreshold,
+			SLOThresholds:    opt.SLOThresholds,
+			SLOBreach:        opt.SLOBreach,
+			PanicLogger:      opt.PanicLogger,
+			MaxConcurrency:   opt.MaxConcurrency,
+			SlowThreshold:    opt.SlowThreshold,
+			Mocks:            opt.Mocks,
+			pool:             newWorkerPool(opt.WorkerPool),
+			rates:            newErrorRates(opt.ErrorRateWindow),
 		},
-		finisher: &defaultFinisher{},
-	}, nil
+		finisher: &defaultFinisher{
+			Output:             opt.Output,
+			ResponseHeaderMeta: opt.ResponseHeaderMeta,
+			StatusPolicy:       opt.StatusPolicy,
+			TransformResponse:  opt.TransformResponse,
+			DeprecationMeta:    opt.DeprecationMeta,
+			ErrCodeFor:         opt.ErrCodeFor,
+			CacheHint:          opt.CacheHint,
+			EmptySections:      opt.EmptySections,
+			SLOMeta:            opt.SLOMeta,
+			Passthrough:        opt.Passthrough,
+			Compress:           opt.Compress,
+			CompressMinBytes:   opt.CompressMinBytes,
+			ErrorBodyBytes:     opt.ErrorBodyBytes,
+			Atomic:             opt.Atomic,
+			Envelope:           opt.Envelope,
+			Summary:            opt.Summary,
+			FinalizeResponse:   opt.FinalizeResponse,
+			SortKeys:           opt.SortKeys,
+			UniformErrors:      opt.UniformErrors,
+			Messages:           opt.Messages,
+			SniffGzip:          opt.SniffGzip,
+			ValidateBody:       opt.ValidateBody,
+		},
+	}
+
+	c.client = &http.Client{Transport: c.httpTransport()}
+
+	return c, nil
+}
+
+func checkScheme(opt *DefaultOption, u *url.URL) error {
+	if !opt.HTTPSOnly {
+		return nil
+	}
+
+	if u.Scheme != "https" {
+		return errPlaintextBackend
+	}
+
+	for _, u := range opt.Services {
+		if u.Scheme != "https" {
+			return errPlaintextBackend
+		}
+	}
+
+	return nil
 }
 
 func (c *DefaultExecutor) Build(r *http.Request) (map[string]*http.Request, error) {
+	if !c.drain.accepting() {
+		return nil, errShuttingDown
+	}
+
+	if c.option.Builder != nil {
+		return c.option.Builder.Build(r)
+	}
+
 	return c.builder.Build(r)
 }
 
 func (c *DefaultExecutor) Fetch(mr map[string]*http.Request) (map[string]*http.Response, error) {
-	return c.fetcher.Fetch(mr, c.httpTransport())
+	if c.drain.enter() {
+		defer c.drain.leave()
+	}
+
+	if c.option.Fetcher != nil {
+		return c.option.Fetcher.Fetch(mr, c.client)
+	}
+
+	return c.fetcher.Fetch(mr, c.client)
+}
+
+func (c *DefaultExecutor) ErrorRates() map[string]ErrorRate {
+	return c.fetcher.rates.Snapshot(time.Now())
+}
+
+func (c *DefaultExecutor) Shutdown(ctx context.Context) error {
+	return c.drain.shutdown(ctx)
+}
+
+func (c *DefaultExecutor) Close() {
+	c.fetcher.pool.Close()
+}
+
+func (c *DefaultExecutor) FetchInto(ctx context.Context, mr map[string]*http.Request, key string, v interface{}) error {
+	if _, ok := mr[key]; !ok {
+		return errUnknownKey
+	}
+
+	rq := make(map[string]*http.Request)
+
+	for k, r := range mr {
+		rq[k] = withSubRequest(r.WithContext(ctx), subRequestOf(r).clone())
+
+		if r.GetBody != nil {
+			rq[k].Body, _ = r.GetBody()
+		}
+	}
+
+	ms, err := c.Fetch(rq)
+	me, _ := err.(ErrorMulti)
+
+	return c.finisher.decode(ms, me, key, v)
 }
 
 func (c *DefaultExecutor) Finish(w http.ResponseWriter, ms map[string]*http.Response, err error) {
+	if c.option.Finisher != nil {
+		c.option.Finisher.Finish(w, ms, err)
+		return
+	}
+
 	c.finisher.Finish(w, ms, err)
 }
 
 func (c *DefaultExecutor) FinishErr(w http.ResponseWriter, code int, err error) {
+	if c.option.Finisher != nil {
+		c.option.Finisher.FinishErr(w, code, err)
+		return
+	}
+
 	c.finisher.FinishErr(w, code, err)
 }
 
+func (c *DefaultExecutor) Ping(ctx context.Context) error {
+	u := *c.builder.BaseURL
+	u.Path = joinPath(u.Path, c.pingPath())
+	u.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	if c.option.Timeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.option.Timeout)
+		defer cancel()
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return errors.New("Backend responded with " + res.Status)
+	}
+
+	return nil
+}
+
+func (c *DefaultExecutor) pingPath() string {
+	if c.option.PingPath == "" {
+		return "/"
+	}
+
+	return c.option.PingPath
+}
+
 func (c *DefaultExecutor) httpTransport() http.RoundTripper {
 	if c.option.Transport == nil {
 		return http.DefaultTransport
@@ -89,365 +444,2238 @@ func (c *DefaultExecutor) httpTransport() http.RoundTripper {
 }
 
 type request struct {
-	Aggregate map[string]payload `json:"aggregate"`
+	Aggregate aggregate   `json:"aggregate"`
+	Body      interface{} `json:"body,omitempty"`
 }
 
-type payload struct {
-	Method  string      `json:"method"`
-	Path    string      `json:"path"`
-	Body    interface{} `json:"body,omitempty"`
-	Timeout int         `json:"timeout,omitempty"`
-}
+type aggregate map[string]payload
+
+func (a *aggregate) UnmarshalJSON(b []byte) error {
+	m := make(map[string]payload)
 
-func (p payload) Bytes() []byte {
-	if p.Body == nil {
+	if err := json.Unmarshal(b, &m); err == nil {
+		ks := make([]string, 0, len(m))
+
+		for k := range m {
+			ks = append(ks, k)
+		}
+
+		sort.Strings(ks)
+
+		for i, k := range ks {
+			p := m[k]
+			p.index = i
+			m[k] = p
+		}
+
+		*a = m
 		return nil
 	}
 
-	b, _ := json.Marshal(p.Body)
-	return b
+	var ps []payload
+
+	if err := json.Unmarshal(b, &ps); err != nil {
+		return err
+	}
+
+	for i, p := range ps {
+		if p.Key == "" {
+			return errMissedQuery
+		}
+
+		if _, ok := m[p.Key]; ok {
+			return errDuplicateKey
+		}
+
+		p.index = i
+		m[p.Key] = p
+	}
+
+	*a = m
+	return nil
+}
+
+type payload struct {
+	index          int
+	Key            string            `json:"key,omitempty"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	Body           interface{}       `json:"body,omitempty"`
+	Timeout        int               `json:"timeout,omitempty"`
+	TTFBTimeout    int               `json:"ttfb_timeout,omitempty"`
+	ConnectTimeout int               `json:"connect_timeout,omitempty"`
+	Fields         []string          `json:"fields,omitempty"`
+	ContentType    string            `json:"content_type,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Service        string            `json:"service,omitempty"`
+	BodyFromPart   string            `json:"body_from_part,omitempty"`
+	If             string            `json:"if,omitempty"`
+	Passthrough    bool              `json:"passthrough,omitempty"`
+	Merge          bool              `json:"merge,omitempty"`
+	Query          url.Values        `json:"query,omitempty"`
+	Priority       int               `json:"priority,omitempty"`
+	ExpectStatus   []int             `json:"expect_status,omitempty"`
+	As             string            `json:"as,omitempty"`
+	MergeInto      string            `json:"merge_into,omitempty"`
+	NoCache        bool              `json:"no_cache,omitempty"`
+}
+
+func (p payload) Bytes() ([]byte, string, error) {
+	return encodeBody(p.ContentType, p.Body)
 }
 
 type defaultBuilder struct {
-	BaseURL        *url.URL
-	DefaultTimeout time.Duration
-	MaxTimeout     time.Duration
-	MaxRequest     int
+	BaseURL         *url.URL
+	DefaultTimeout  time.Duration
+	MaxTimeout      time.Duration
+	TTFBTimeout     time.Duration
+	ConnectTimeout  time.Duration
+	MaxRequest      int
+	MaxRequestBytes int64
+	Warnings        bool
+	Filters         []Filter
+	OnEmpty         EmptyMode
+	PathRewrites    []Rewrite
+	EchoHeaders     func(r *http.Request) bool
+	CacheHint       bool
+	ForwardedFor    bool
+	TrustedProxies  []*net.IPNet
+	StripHeaders    []string
+	Services        map[string]*url.URL
+	HTTPSOnly       bool
+	MaxPartBytes    int64
+	UserAgent       string
+	TimeoutJitter   float64
+	KeyPattern      *regexp.Regexp
+	AllowedMethods  []string
+	SignRequest     func(r *http.Request)
+	RejectEmpty     bool
+	TimeoutBudget   time.Duration
+	Dedupe          bool
+	OriginalHeaders []string
+	RejectOverride  bool
+	OverrideLogger  func(r *http.Request, name string)
+	MaxPathLength   int
+	MaxQueryBytes   int
+	DeadlineHeader  string
+	ContextHeaders  map[interface{}]string
+	StrictEnvelope  bool
 }
 
 func (x *defaultBuilder) Build(r *http.Request) (map[string]*http.Request, error) {
+	r = r.WithContext(context.WithValue(r.Context(), aggregateStartKey{}, time.Now()))
 	v := new(request)
 
-	err := json.NewDecoder(r.Body).Decode(v)
+	for _, s := range originalOverrides(r, x.OriginalHeaders) {
+		if x.RejectOverride {
+			return nil, errHeaderOverride
+		}
+
+		if x.OverrideLogger != nil {
+			x.OverrideLogger(r, s)
+		}
+	}
+
+	deadline, capped := x.deadline(r)
+	if capped && deadline <= 0 {
+		return nil, errDeadlineExceeded
+	}
+
+	body, parts, err := x.readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(body)
+
+	if x.StrictEnvelope {
+		dec.DisallowUnknownFields()
+	}
+
+	err = dec.Decode(v)
 	if err != nil {
+		if s := unknownField(err); s != "" {
+			return nil, errors.New("Unknown aggregate field " + s)
+		}
+
 		return nil, errMissedQuery
 	}
 
+	if x.RejectEmpty && len(v.Aggregate) == 0 {
+		return nil, errEmptyAggregate
+	}
+
 	if x.MaxRequest != 0 && len(v.Aggregate) > x.MaxRequest {
 		return nil, errTooManyRequests
 	}
 
+	if x.TimeoutBudget != 0 && x.totalTimeout(v.Aggregate) > x.TimeoutBudget {
+		return nil, errTimeoutBudget
+	}
+
+	if sharesStream(v.Aggregate) {
+		return nil, errSharedStream
+	}
+
+	if x.KeyPattern != nil {
+		for k := range v.Aggregate {
+			if !x.KeyPattern.MatchString(k) {
+				return nil, errInvalidKey
+			}
+		}
+	}
+
+	if !uniqueOutputKeys(v.Aggregate) {
+		return nil, errDuplicateOutput
+	}
+
+	if !distinctMergeTargets(v.Aggregate) {
+		return nil, errMergeTarget
+	}
+
 	mr := make(map[string]*http.Request)
+	fm := make(map[string]*http.Request)
+	fs := make(ErrorMulti)
+	echo := x.EchoHeaders != nil && x.EchoHeaders(r)
+
+	fallback := v.Body
 
 	for k, v := range v.Aggregate {
+		if v.Body == nil && v.BodyFromPart == "" {
+			v.Body = fallback
+		}
+
+		v = expandPayload(r, v)
+
 		req := x.cloneRequest(r, v)
-		req.URL.Scheme = x.BaseURL.Scheme
-		req.URL.Host = x.BaseURL.Host
-		req.Host = x.BaseURL.Host
-		req.Header.Set("X-Timeout", x.Timeout(v).String())
+		sr := subRequestOf(req)
+
+		if v.BodyFromPart != "" {
+			x.partBody(req, parts, v.BodyFromPart)
+		}
+
+		base, ok := x.baseURL(v.Service)
+		if !ok {
+			req.Header.Set("X-Invalid", "service")
+		}
+
+		sr.service = v.Service
+
+		req.URL.Scheme = base.Scheme
+		req.URL.Host = base.Host
+		req.Host = base.Host
+
+		joinBasePath(req.URL, base)
+
+		if x.HTTPSOnly && req.URL.Scheme != "https" {
+			req.Header.Set("X-Invalid", "scheme")
+		}
+
+		if !x.methodAllowed(req.Method) {
+			req.Header.Set("X-Invalid", "method")
+		}
+
+		timeout := x.Timeout(v)
+
+		if capped && (timeout == 0 || timeout > deadline) {
+			timeout = deadline
+			x.warn(req, "timeout capped to upstream deadline of "+deadline.String())
+		}
+
+		req.Header.Set("X-Timeout", timeout.String())
+
+		sr.index = v.index
+		sr.fields = v.Fields
+		sr.merge = v.Merge
+		sr.priority = v.Priority
+		sr.ttfb = x.TimeToFirstByte(v)
+		sr.connect = x.TimeToConnect(v)
+		sr.mergeInto = v.MergeInto
+		sr.passthrough = v.Passthrough
+		sr.as = v.As
+		sr.expect = v.ExpectStatus
+
+		if v.If != "" {
+			sr.cond = v.If
 
+			if _, err := parseCondition(v.If); err != nil {
+				req.Header.Set("X-Invalid", "condition")
+			}
+		}
+
+		if x.MaxTimeout > 0 && time.Duration(v.Timeout)*time.Millisecond > x.MaxTimeout {
+			x.warn(req, "timeout clamped to "+x.MaxTimeout.String())
+		}
+
+		if echo {
+			req = req.WithContext(context.WithValue(req.Context(), echoHeadersKey{}, true))
+		}
+
+		if s := r.Header.Get("Accept"); s != "" {
+			req = req.WithContext(context.WithValue(req.Context(), acceptKey{}, s))
+		}
+
+		if s := r.Header.Get("Accept-Encoding"); s != "" {
+			req = req.WithContext(context.WithValue(req.Context(), acceptEncodingKey{}, s))
+		}
+
+		if err := x.filter(k, req); err != nil {
+			fs[k] = err
+			sr.filtered = err
+			req.Header.Set("X-Invalid", "filter")
+			fm[k] = req
+			continue
+		}
+
+		x.sign(req)
+
+		if x.Dedupe {
+			if s := dedupeKey(req); s != "" {
+				sr.dedupe = s
+			}
+		}
+
+		mr[k] = req
+	}
+
+	if len(mr) == 0 && len(fs) != 0 {
+		return x.empty(mr, fs)
+	}
+
+	for k, req := range fm {
 		mr[k] = req
 	}
 
+	if hasConditionCycle(mr) {
+		return nil, errCyclicCondition
+	}
+
+	if x.CacheHint {
+		s := cacheKey(mr)
+
+		for _, req := range mr {
+			subRequestOf(req).cacheKey = s
+		}
+	}
+
 	return mr, nil
 }
 
-func (x *defaultBuilder) Timeout(p payload) time.Duration {
-	if p.Timeout == 0 {
-		return x.DefaultTimeout
+func (x *defaultBuilder) filter(k string, r *http.Request) error {
+	for _, f := range x.Filters {
+		if err := f(k, r); err != nil {
+			return err
+		}
 	}
 
-	n := time.Duration(p.Timeout) * time.Millisecond
+	return nil
+}
 
-	if n > x.MaxTimeout {
-		return x.MaxTimeout
+func (x *defaultBuilder) empty(mr map[string]*http.Request, fs ErrorMulti) (map[string]*http.Request, error) {
+	switch x.OnEmpty {
+	case EmptyBadRequest:
+		return nil, errNoExecutable
+	case EmptyReasons:
+		return nil, filterError{reasons: fs}
 	}
 
-	return n
+	return mr, nil
 }
 
-func (x *defaultBuilder) httpMethod(t payload) string {
-	if t.Method == "" {
-		return "GET"
+func (x *defaultBuilder) readRequest(r *http.Request) (io.Reader, map[string]formPart, error) {
+	if !isMultipart(r) {
+		body, err := x.readBody(r)
+		return body, nil, err
 	}
 
-	return t.Method
+	if x.MaxRequestBytes != 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, x.MaxRequestBytes)
+	}
+
+	return readMultipart(r, x.MaxPartBytes)
 }
 
-func (x *defaultBuilder) cloneRequest(r *http.Request, t payload) *http.Request {
-	req := httpclone.Request(r)
-	req.RequestURI = ""
-	req.Method = x.httpMethod(t)
+func (x *defaultBuilder) partBody(req *http.Request, parts map[string]formPart, name string) {
+	p, ok := parts[name]
+	if !ok {
+		req.Header.Set("X-Invalid", "part")
+		return
+	}
 
-	u, err := url.Parse(t.Path)
-	if err != nil {
-		req.URL.Path = t.Path
-		req.Header.Set("X-Invalid", "true")
-		return req
+	if p.Stream != nil {
+		req.Header.Set("Content-Type", p.ContentType)
+		req.Body = ioutil.NopCloser(p.Stream)
+		req.ContentLength = -1
+		req.GetBody = nil
+		return
 	}
 
-	if u.Path == "" {
-		u.Path = "/"
+	setBody(req, p.Content, p.ContentType)
+}
+
+func (x *defaultBuilder) readBody(r *http.Request) (io.Reader, error) {
+	if x.MaxRequestBytes == 0 {
+		return r.Body, nil
 	}
 
-	q := req.URL.Query()
+	b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, x.MaxRequestBytes))
+	if err != nil && int64(len(b)) >= x.MaxRequestBytes {
+		return nil, errRequestTooLarge
+	}
 
-	for k, v := range u.Query() {
-		q[k] = v
+	return bytes.NewReader(b), nil
+}
+
+func (x *defaultBuilder) totalTimeout(a aggregate) time.Duration {
+	var n time.Duration
+
+	for _, p := range a {
+		n += x.timeout(p)
 	}
 
-	req.URL = u
-	req.URL.RawQuery = q.Encode()
+	return n
+}
 
-	if req.URL.Host != "" {
-		req.Header.Set("X-Invalid", "true")
-		return req
+func unknownField(err error) string {
+	const prefix = "json: unknown field "
+
+	if s := err.Error(); strings.HasPrefix(s, prefix) {
+		return strings.TrimPrefix(s, prefix)
 	}
 
-	for k := range req.Header {
-		if strings.HasSuffix(k, "-Original") {
-			s := strings.Replace(k, "-Original", "", 1)
-			req.Header.Set(s, r.Header.Get(k))
-			req.Header.Del(k)
-		}
+	return ""
+}
+
+func (x *defaultBuilder) deadline(r *http.Request) (time.Duration, bool) {
+	if x.DeadlineHeader == "" {
+		return 0, false
+	}
+
+	return upstreamDeadline(r, x.DeadlineHeader, time.Now())
+}
+
+func (x *defaultBuilder) Timeout(p payload) time.Duration {
+	return x.jitter(x.timeout(p))
+}
+
+func (x *defaultBuilder) jitter(n time.Duration) time.Duration {
+	if x.TimeoutJitter <= 0 || n == 0 {
+		return n
+	}
+
+	n = time.Duration(float64(n) * (1 + x.TimeoutJitter*(2*rand.Float64()-1)))
+
+	if x.MaxTimeout != 0 && n > x.MaxTimeout {
+		return x.MaxTimeout
+	}
+
+	return n
+}
+
+func (x *defaultBuilder) timeout(p payload) time.Duration {
+	if p.Timeout == 0 {
+		return x.DefaultTimeout
+	}
+
+	n := time.Duration(p.Timeout) * time.Millisecond
+
+	if n > x.MaxTimeout {
+		return x.MaxTimeout
+	}
+
+	return n
+}
+
+// Connect and time to first byte timeouts are measured from the start of
+// each attempt and fail the sub-request on their own, independently of the
+// overall timeout. Payload values override the defaults and are clamped to
+// MaxTimeout, so none of them can outlive the overall timeout ceiling.
+func (x *defaultBuilder) TimeToFirstByte(p payload) time.Duration {
+	return x.phaseTimeout(p.TTFBTimeout, x.TTFBTimeout)
+}
+
+func (x *defaultBuilder) TimeToConnect(p payload) time.Duration {
+	return x.phaseTimeout(p.ConnectTimeout, x.ConnectTimeout)
+}
+
+func (x *defaultBuilder) phaseTimeout(ms int, d time.Duration) time.Duration {
+	n := d
+
+	if ms != 0 {
+		n = time.Duration(ms) * time.Millisecond
+	}
+
+	if x.MaxTimeout != 0 && n > x.MaxTimeout {
+		return x.MaxTimeout
+	}
+
+	return n
+}
+
+func (x *defaultBuilder) warn(r *http.Request, msg string) {
+	if x.Warnings {
+		s := subRequestOf(r)
+		s.warnings = append(s.warnings, msg)
+	}
+}
+
+func (x *defaultBuilder) baseURL(service string) (*url.URL, bool) {
+	if service == "" {
+		return x.BaseURL, true
+	}
+
+	if u, ok := x.Services[service]; ok {
+		return u, true
+	}
+
+	return x.BaseURL, false
+}
+
+func joinBasePath(u, base *url.URL) {
+	if base.Path == "" || base.Path == "/" {
+		return
+	}
+
+	if u.RawPath != "" {
+		u.RawPath = joinPath(base.EscapedPath(), u.RawPath)
+	}
+
+	u.Path = joinPath(base.Path, u.Path)
+}
+
+func joinPath(base, s string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(s, "/")
+}
+
+func (x *defaultBuilder) methodAllowed(method string) bool {
+	if len(x.AllowedMethods) == 0 {
+		return true
+	}
+
+	for _, s := range x.AllowedMethods {
+		if strings.EqualFold(s, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x *defaultBuilder) sign(req *http.Request) {
+	if x.SignRequest == nil {
+		return
+	}
+
+	x.SignRequest(req)
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			req.Body = body
+		}
+	}
+}
+
+func (x *defaultBuilder) maxPathLength() int {
+	if x.MaxPathLength == 0 {
+		return defaultMaxPathLength
+	}
+
+	return x.MaxPathLength
+}
+
+func (x *defaultBuilder) maxQueryBytes() int {
+	if x.MaxQueryBytes == 0 {
+		return defaultMaxQueryBytes
+	}
+
+	return x.MaxQueryBytes
+}
+
+func (x *defaultBuilder) httpMethod(t payload) string {
+	if t.Method == "" {
+		return "GET"
+	}
+
+	return t.Method
+}
+
+func (x *defaultBuilder) cloneRequest(r *http.Request, t payload) *http.Request {
+	req := withSubRequest(httpclone.Request(r), &subRequest{})
+	req.RequestURI = ""
+	req.Method = x.httpMethod(t)
+
+	stripInternal(req.Header)
+
+	u, err := url.Parse(t.Path)
+	if err != nil {
+		req.URL.Path = t.Path
+		req.Header.Set("X-Invalid", "path")
+		return req
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	u.Path = rewritePath(x.PathRewrites, u.Path)
+
+	q := req.URL.Query()
+
+	for k, v := range u.Query() {
+		q[k] = v
+	}
+
+	for k, v := range t.Query {
+		q[k] = v
+	}
+
+	req.URL = u
+	req.URL.RawQuery = q.Encode()
+
+	if req.URL.Host != "" {
+		req.Header.Set("X-Invalid", "host")
+		return req
+	}
+
+	if len(req.URL.Path) > x.maxPathLength() || len(req.URL.RawQuery) > x.maxQueryBytes() {
+		req.Header.Set("X-Invalid", "uri")
+		return req
+	}
+
+	if x.UserAgent != "" {
+		req.Header.Set("User-Agent", x.UserAgent)
+	}
+
+	for k := range req.Header {
+		if strings.HasSuffix(k, originalSuffix) {
+			if s := originalName(k); originalAllowed(x.OriginalHeaders, s) && !internalHeader(s) {
+				req.Header.Set(s, r.Header.Get(k))
+			}
+
+			req.Header.Del(k)
+		}
+	}
+
+	for k, v := range t.Headers {
+		if !internalHeader(k) {
+			req.Header.Set(k, v)
+		}
+	}
+
+	if t.NoCache {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+
+	if x.ForwardedFor {
+		xff, ip := forwardedFor(r, x.TrustedProxies)
+		req.Header.Set("X-Forwarded-For", xff)
+		req.Header.Set("X-Real-Ip", ip)
+	}
+
+	for key, name := range x.ContextHeaders {
+		if v := r.Context().Value(key); v != nil {
+			req.Header.Set(name, fmt.Sprint(v))
+		}
+
+		sr := subRequestOf(req)
+		sr.keyHeaders = append(sr.keyHeaders, name)
+	}
+
+	for _, k := range x.StripHeaders {
+		req.Header.Del(k)
+	}
+
+	b, contentType, err := t.Bytes()
+	if err != nil {
+		req.Header.Set("X-Invalid", "body")
+		return req
+	}
+
+	if contentType == "" && isMultipart(r) {
+		req.Header.Del("Content-Type")
+
+		if len(b) != 0 {
+			contentType = "application/json"
+		}
+	}
+
+	setBody(req, b, contentType)
+	return req
+}
+
+func setBody(req *http.Request, b []byte, contentType string) {
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if len(b) == 0 {
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		req.GetBody = func() (io.ReadCloser, error) {
+			return http.NoBody, nil
+		}
+
+		return
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+type defaultFetcher struct {
+	MaxRetry         int
+	RetryBudget      int
+	Tracer           Tracer
+	ErrCodeFor       func(statusCode int, timeout bool) int
+	DryRun           bool
+	FetchLatency     func(n time.Duration, method, routePattern string, statusCode int)
+	FetchError       func(n time.Duration, method, routePattern, class string)
+	FetchLogger      func(n time.Duration, method, urlPath string, statusCode int, reqID string)
+	RequestLogger    func(r *http.Request, n time.Duration, statusCode int)
+	AggregateLatency func(total time.Duration, count, failed int)
+	InvalidPathError bool
+	Cache            Cache
+	SLOThreshold     time.Duration
+	SLOThresholds    map[string]time.Duration
+	SLOBreach        func(n time.Duration, method, routePattern string)
+	PanicLogger      func(key string, v interface{}, stack []byte)
+	MaxConcurrency   int
+	SlowThreshold    time.Duration
+	Mocks            map[string]Mock
+	pool             *workerPool
+	rates            *errorRates
+}
+
+func (x *defaultFetcher) Fetch(mr map[string]*http.Request, htc *http.Client) (map[string]*http.Response, error) {
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	mu := &sync.Mutex{}
+	ms := make(map[string]*http.Response)
+	es := make(ErrorMulti)
+	rb := newRetryBudget(x.RetryBudget)
+	deps := newDependencies(mr)
+	queue := newFetchQueue(x.MaxConcurrency)
+	flights := newFlightGroup()
+	children := make(map[string][]string)
+
+	var roots []string
+
+	for k, v := range mr {
+		if c, ok := requestCondition(v); ok {
+			if _, ok := mr[c.Key]; ok {
+				children[c.Key] = append(children[c.Key], k)
+				continue
+			}
+		}
+
+		roots = append(roots, k)
+	}
+
+	var schedule func(s string)
+
+	fetch := func(s string, r *http.Request) {
+		var done bool
+
+		defer wg.Done()
+		defer func() {
+			for _, k := range children[s] {
+				schedule(k)
+			}
+		}()
+		defer queue.Release()
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+
+			x.recovered(s, r, v)
+
+			if !done {
+				deps.Done(s, nil)
+			}
+
+			mu.Lock()
+			delete(ms, s)
+			es[s] = x.panicError(r)
+			mu.Unlock()
+		}()
+
+		start := time.Now()
+		r, span := x.startSpan(r)
+		res, err := flights.Do(r, func() (*http.Response, error) {
+			return x.fetchRetry(r, htc, rb)
+		})
+
+		if err != nil {
+			err = x.buildError(r, err)
+		}
+
+		done = true
+		deps.Done(s, res)
+
+		span.End(r.Method, x.routePattern(res), x.statusCode(res, err), err)
+		x.recordRate(r, res, err)
+
+		dur := time.Since(start)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		x.fetchLatency(dur, r, res, err)
+		x.fetchError(dur, r, res, err)
+		x.fetchLogger(dur, r, res, err)
+		x.sloBreach(dur, r, res)
+
+		if err != nil {
+			es[s] = err
+		} else {
+			ms[s] = res
+		}
+	}
+
+	schedule = func(s string) {
+		r := mr[s]
+
+		if !deps.Wait(r) {
+			mu.Lock()
+			ms[s] = skippedResponse(r)
+			mu.Unlock()
+
+			deps.Done(s, nil)
+
+			for _, k := range children[s] {
+				schedule(k)
+			}
+
+			wg.Done()
+			return
+		}
+
+		queue.Acquire(r, func() {
+			x.pool.Go(func() { fetch(s, r) })
+		})
+	}
+
+	wg.Add(len(mr))
+
+	for _, s := range roots {
+		schedule(s)
+	}
+
+	queue.Start()
+	wg.Wait()
+
+	x.aggregateLatency(time.Since(start), ms, es)
+
+	return ms, es
+}
+
+func (x *defaultFetcher) startSpan(r *http.Request) (*http.Request, Span) {
+	if x.Tracer == nil {
+		return r, noopSpan{}
+	}
+
+	return x.Tracer.Start(r)
+}
+
+func (x *defaultFetcher) recordRate(r *http.Request, res *http.Response, err error) {
+	if x.rates == nil || r.Header.Get("X-Invalid") != "" {
+		return
+	}
+
+	route := rateUnmatched
+
+	if s := x.routePattern(res); s != "" {
+		route = r.Method + " " + s
+	}
+
+	x.rates.Record(route, err != nil || x.statusCode(res, err) >= http.StatusInternalServerError, time.Now())
+}
+
+func (x *defaultFetcher) fetchLatency(n time.Duration, r *http.Request, res *http.Response, err error) {
+	x.FetchLatency(n, r.Method, x.routePattern(res), x.statusCode(res, err))
+}
+
+func (x *defaultFetcher) fetchError(n time.Duration, r *http.Request, res *http.Response, err error) {
+	if x.FetchError == nil || err == nil {
+		return
+	}
+
+	x.FetchError(n, r.Method, x.routePattern(res), errorClass(err))
+}
+
+func errorClass(err error) string {
+	z, ok := err.(Error)
+
+	switch {
+	case !ok:
+		return "error"
+	case z.ErrDNS:
+		return "dns"
+	case z.ErrRefused:
+		return "refused"
+	case z.ErrTLS:
+		return "tls"
+	case z.ErrTimeout:
+		return "timeout"
+	}
+
+	return "error"
+}
+
+func (x *defaultFetcher) aggregateLatency(n time.Duration, ms map[string]*http.Response, es ErrorMulti) {
+	if x.AggregateLatency == nil {
+		return
+	}
+
+	failed := len(es)
+
+	for _, res := range ms {
+		if res.StatusCode >= http.StatusBadRequest {
+			failed++
+		}
+	}
+
+	x.AggregateLatency(n, len(ms)+len(es), failed)
+}
+
+func (x *defaultFetcher) sloBreach(n time.Duration, r *http.Request, res *http.Response) {
+	threshold := x.SLOThreshold
+
+	if t, ok := x.SLOThresholds[subRequestOf(r).service]; ok {
+		threshold = t
+	}
+
+	if threshold == 0 || n <= threshold || res == nil {
+		return
+	}
+
+	subRequestOf(r).sloBreach = true
+
+	if x.SLOBreach != nil {
+		x.SLOBreach(n, r.Method, x.routePattern(res))
+	}
+}
+
+func (x *defaultFetcher) recovered(key string, r *http.Request, v interface{}) {
+	stack := debug.Stack()
+
+	if x.PanicLogger != nil {
+		x.PanicLogger(key, v, stack)
+		return
+	}
+
+	log.Printf("buffon: panic fetching %s %s %s: %v\n%s", key, r.Method, r.URL.Path, v, stack)
+}
+
+func (x *defaultFetcher) panicError(r *http.Request) error {
+	return Error{
+		Path:       r.URL.Path,
+		Method:     r.Method,
+		Message:    errInternalPanic.Error(),
+		StatusCode: http.StatusInternalServerError,
+		ErrCode:    errCode(x.ErrCodeFor, http.StatusInternalServerError, false),
+		request:    r,
+	}
+}
+
+func (x *defaultFetcher) fetchLogger(n time.Duration, r *http.Request, res *http.Response, err error) {
+	code := x.statusCode(res, err)
+
+	if x.SlowThreshold != 0 && n <= x.SlowThreshold && code < http.StatusBadRequest {
+		return
+	}
+
+	x.FetchLogger(n, r.Method, r.URL.Path, code, r.Header.Get("X-Request-Id"))
+
+	if x.RequestLogger != nil {
+		x.RequestLogger(r, n, code)
+	}
+}
+
+func (x *defaultFetcher) statusCode(res *http.Response, err error) int {
+	if res != nil {
+		return res.StatusCode
+	}
+
+	if err, ok := err.(Error); ok {
+		return err.StatusCode
+	}
+
+	return http.StatusBadGateway
+}
+
+func (x *defaultFetcher) routePattern(res *http.Response) string {
+	if res != nil {
+		return res.Header.Get("X-Route-Pattern")
+	}
+
+	return ""
+}
+
+func (x *defaultFetcher) fetchRetry(r *http.Request, htc *http.Client, rb *retryBudget) (*http.Response, error) {
+	res, err := x.fetch(r, htc)
+
+	for i := 0; err != nil && !isLocalError(err) && i < x.MaxRetry; i++ {
+		if !isIdempotent(r.Method) || r.GetBody == nil || !rb.Take() {
+			break
+		}
+
+		r.Body, _ = r.GetBody()
+		res, err = x.fetch(r, htc)
+	}
+
+	return res, err
+}
+
+func (x *defaultFetcher) fetch(r *http.Request, htc *http.Client) (*http.Response, error) {
+	switch r.Header.Get("X-Invalid") {
+	case "":
+	case "service":
+		return nil, errUnknownService
+	case "scheme":
+		return nil, errPlaintextBackend
+	case "part":
+		return nil, errUnknownPart
+	case "condition":
+		return nil, errInvalidCondition
+	case "method":
+		return nil, errMethodNotAllowed
+	case "uri":
+		return nil, errURITooLong
+	case "filter":
+		return nil, filteredError{err: subRequestOf(r).filtered}
+	default:
+		if x.InvalidPathError {
+			return nil, errInvalidPath
+		}
+
+		return x.localResponse(r)
+	}
+
+	if x.DryRun {
+		return x.dryRunResponse(r)
+	}
+
+	if res, ok := mockResponse(x.Mocks, r); ok {
+		return res, nil
+	}
+
+	cacheable := x.Cache != nil && isCacheable(r)
+
+	if cacheable && !noCache(r) {
+		if res, ok := cachedResponse(x.Cache, r); ok {
+			return res, nil
+		}
+	}
+
+	ctx, cancel := x.withTimeout(r)
+
+	connect := subRequestOf(r).connect
+	ttfb := subRequestOf(r).ttfb
+
+	var res *http.Response
+	var err error
+
+	if connect == 0 && ttfb == 0 {
+		res, err = htc.Do(r.WithContext(ctx))
+	} else {
+		res, err = x.fetchDeadline(htc, r.WithContext(ctx), connect, ttfb)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = cancelBody{ReadCloser: res.Body, cancel: cancel}
+
+	if cacheable {
+		storeResponse(x.Cache, r, res)
+	}
+
+	return res, nil
+}
+
+func (x *defaultFetcher) withTimeout(r *http.Request) (context.Context, context.CancelFunc) {
+	if t, err := time.ParseDuration(r.Header.Get("X-Timeout")); err == nil && t != 0 {
+		return context.WithTimeout(r.Context(), t)
+	}
+
+	return context.WithCancel(r.Context())
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (x *defaultFetcher) fetchDeadline(htc *http.Client, r *http.Request, connect, ttfb time.Duration) (*http.Response, error) {
+	var expired atomic.Value
+
+	ctx, cancel := context.WithCancel(r.Context())
+
+	deadline := func(n time.Duration, name string) func() {
+		if n == 0 {
+			return func() {}
+		}
+
+		t := time.AfterFunc(n, func() {
+			expired.Store(errDeadline{name: name, n: n})
+			cancel()
+		})
+
+		return func() { t.Stop() }
+	}
+
+	stopConnect := deadline(connect, "connect timeout")
+	stopTTFB := deadline(ttfb, "time to first byte")
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			stopConnect()
+		},
+		GotFirstResponseByte: stopTTFB,
+	}
+
+	res, err := htc.Do(r.WithContext(httptrace.WithClientTrace(ctx, trace)))
+
+	stopConnect()
+	stopTTFB()
+
+	if err != nil {
+		if v := expired.Load(); v != nil {
+			return nil, v.(error)
+		}
+	}
+
+	return res, err
+}
+
+func (x *defaultFetcher) localResponse(r *http.Request) (*http.Response, error) {
+	type Meta struct {
+		StatusCode int `json:"http_status"`
+	}
+
+	msg, ok := invalidMessages[r.Header.Get("X-Invalid")]
+	if !ok {
+		msg = http.StatusText(http.StatusNotFound)
+	}
+
+	b, _ := json.Marshal(struct {
+		Errors []Error `json:"errors"`
+		Meta   Meta    `json:"meta"`
+	}{
+		Errors: []Error{{
+			Message: r.Method + " " + r.URL.Path + ": " + msg,
+			ErrCode: errCode(x.ErrCodeFor, http.StatusNotFound, false),
+		}},
+		Meta: Meta{StatusCode: http.StatusNotFound},
+	})
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%03d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+		StatusCode:    http.StatusNotFound,
+		Request:       r,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}, nil
+}
+
+func (x *defaultFetcher) dryRunResponse(r *http.Request) (*http.Response, error) {
+	type Data struct {
+		Method  string      `json:"method"`
+		URL     string      `json:"url"`
+		Header  http.Header `json:"headers"`
+		Timeout string      `json:"timeout"`
+		Body    string      `json:"body,omitempty"`
+	}
+
+	type Meta struct {
+		StatusCode int `json:"http_status"`
+	}
+
+	var body []byte
+
+	if r.Body != nil {
+		body, _ = ioutil.ReadAll(r.Body)
+	}
+
+	b, err := json.Marshal(struct {
+		Data Data `json:"data"`
+		Meta Meta `json:"meta"`
+	}{
+		Data: Data{
+			Method:  r.Method,
+			URL:     r.URL.String(),
+			Header:  redactHeaders(r.Header),
+			Timeout: r.Header.Get("X-Timeout"),
+			Body:    string(body),
+		},
+		Meta: Meta{StatusCode: http.StatusOK},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%03d %s", http.StatusOK, http.StatusText(http.StatusOK)),
+		StatusCode:    http.StatusOK,
+		Request:       r,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+	}, nil
+}
+
+func (x *defaultFetcher) buildError(req *http.Request, err error) error {
+	message := err.Error()
+	statusErrCode := http.StatusBadGateway
+
+	var errTimeout bool
+
+	if isLocalError(err) {
+		statusErrCode = localErrStatus(err)
+	}
+
+	dns := dnsError(err)
+	refused := refusedError(err)
+	tlsErr := tlsError(err)
+
+	if _, ok := err.(errDeadline); ok {
+		errTimeout = true
+	} else if dns != nil {
+		errTimeout = dns.IsTimeout
+		message = dns.Error()
+	} else if refused != nil {
+		message = "Connection refused by " + refused.Addr.String()
+	} else if tlsErr != nil {
+		message = "TLS handshake failed: " + tlsErr.Error()
+	} else if err, ok := err.(net.Error); ok {
+		if err.Timeout() {
+			errTimeout = true
+			message = "timeout of " + req.Header.Get("X-Timeout") + " exceeded"
+		} else {
+			message = err.(*url.Error).Err.Error()
+		}
+	}
+
+	if errTimeout {
+		statusErrCode = http.StatusGatewayTimeout
+	}
+
+	if !isLocalError(err) && req.Context().Err() != nil {
+		statusErrCode = http.StatusRequestTimeout
+		message = "client request ended before the backend responded"
+	}
+
+	code := errCode(x.ErrCodeFor, statusErrCode, errTimeout)
+
+	if isLocalError(err) && x.ErrCodeFor == nil {
+		code = localErrCode(err)
+	}
+
+	if x.ErrCodeFor == nil {
+		switch {
+		case dns != nil:
+			code = 10005
+		case refused != nil:
+			code = 10008
+		case tlsErr != nil:
+			code = 10009
+		}
+	}
+
+	return Error{
+		Path:       req.URL.Path,
+		Method:     req.Method,
+		Message:    message,
+		StatusCode: statusErrCode,
+		ErrCode:    code,
+		ErrTimeout: errTimeout,
+		ErrDNS:     dns != nil,
+		ErrRefused: refused != nil,
+		ErrTLS:     tlsErr != nil,
+		request:    req,
+	}
+}
+
+func dnsError(err error) *net.DNSError {
+	for _, err := range errorChain(err) {
+		if z, ok := err.(*net.DNSError); ok {
+			return z
+		}
+	}
+
+	return nil
+}
+
+func refusedError(err error) *net.OpError {
+	var op *net.OpError
+
+	for _, err := range errorChain(err) {
+		switch z := err.(type) {
+		case *net.OpError:
+			op = z
+		case syscall.Errno:
+			if z == syscall.ECONNREFUSED && op != nil {
+				return op
+			}
+		}
+	}
+
+	return nil
+}
+
+func tlsError(err error) error {
+	for _, err := range errorChain(err) {
+		switch z := err.(type) {
+		case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return z
+		case *url.Error, *net.OpError, *os.SyscallError:
+			continue
+		}
+
+		if s := err.Error(); strings.HasPrefix(s, "tls: ") || strings.HasPrefix(s, "x509: ") || strings.HasPrefix(s, "remote error: tls: ") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func errorChain(err error) []error {
+	var es []error
+
+	for err != nil {
+		es = append(es, err)
+
+		switch z := err.(type) {
+		case *url.Error:
+			err = z.Err
+		case *net.OpError:
+			err = z.Err
+		case *os.SyscallError:
+			err = z.Err
+		default:
+			err = nil
+		}
+	}
+
+	return es
+}
+
+func isLocalError(err error) bool {
+	return localErrCode(err) != 0
+}
+
+func localErrCode(err error) int {
+	if _, ok := err.(filteredError); ok {
+		return 10011
+	}
+
+	switch err {
+	case errInvalidPath:
+		return 10001
+	case errUnknownService:
+		return 10002
+	case errPlaintextBackend:
+		return 10003
+	case errUnknownPart:
+		return 10004
+	case errInvalidCondition:
+		return 10006
+	case errMethodNotAllowed:
+		return 10007
+	case errURITooLong:
+		return 10010
+	}
+
+	return 0
+}
+
+func localErrStatus(err error) int {
+	if _, ok := err.(filteredError); ok {
+		return http.StatusForbidden
+	}
+
+	switch err {
+	case errMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case errURITooLong:
+		return http.StatusRequestURITooLong
+	}
+
+	return http.StatusBadRequest
+}
+
+func errCode(fn func(statusCode int, timeout bool) int, code int, timeout bool) int {
+	if fn == nil {
+		return 10000
+	}
+
+	return fn(code, timeout)
+}
+
+func aggregateIndex(r *http.Request) int {
+	return subRequestOf(r).index
+}
+
+func aggregateFields(r *http.Request) []string {
+	return subRequestOf(r).fields
+}
+
+func aggregateExpect(r *http.Request) []int {
+	return subRequestOf(r).expect
+}
+
+func expectedStatus(res *http.Response) bool {
+	ns := aggregateExpect(res.Request)
+	if len(ns) == 0 {
+		return res.StatusCode >= http.StatusOK && res.StatusCode < http.StatusMultipleChoices
+	}
+
+	for _, n := range ns {
+		if n == res.StatusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func aggregateMerge(r *http.Request) bool {
+	return subRequestOf(r).merge
+}
+
+func aggregateMergeInto(r *http.Request) string {
+	return subRequestOf(r).mergeInto
+}
+
+func anyRequest(rq map[string]*http.Request) *http.Request {
+	for _, r := range rq {
+		return r
+	}
+
+	return nil
+}
+
+func aggregateWarnings(r *http.Request) []string {
+	return subRequestOf(r).warnings
+}
+
+type response struct {
+	mu      *sync.Mutex
+	empty   EmptySection
+	message MessageMode
+	Data    map[string]interface{} `json:"data"`
+	Message map[string]string      `json:"message,omitempty"`
+	Meta    map[string]interface{} `json:"meta"`
+	Error   map[string][]Error     `json:"error"`
+	Warning map[string][]string    `json:"warnings,omitempty"`
+	Cache   *cacheHint             `json:"cache,omitempty"`
+	Summary *summary               `json:"summary,omitempty"`
+	Errors  []aggregateError       `json:"errors,omitempty"`
+}
+
+type aggregateError struct {
+	Message string `json:"message"`
+}
+
+func (r *response) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{})
+
+	r.section(m, "data", r.Data, len(r.Data))
+	r.section(m, "meta", r.Meta, len(r.Meta))
+	r.section(m, "error", r.Error, len(r.Error))
+
+	if ms := r.messages(); len(ms) != 0 || r.message == MessageAlways {
+		m["message"] = ms
+	}
+
+	if len(r.Warning) != 0 {
+		m["warnings"] = r.Warning
+	}
+
+	if r.Cache != nil {
+		m["cache"] = r.Cache
+	}
+
+	if r.Summary != nil {
+		m["summary"] = r.Summary
+	}
+
+	if len(r.Errors) != 0 {
+		m["errors"] = r.Errors
+	}
+
+	return json.Marshal(m)
+}
+
+func (r *response) messages() map[string]string {
+	switch r.message {
+	case MessageOmit:
+		return nil
+	case MessageOnError:
+		ms := make(map[string]string)
+
+		for k, v := range r.Message {
+			if len(r.Error[k]) != 0 {
+				ms[k] = v
+			}
+		}
+
+		return ms
+	case MessageAlways:
+		ms := make(map[string]string)
+
+		for _, k := range r.keys() {
+			ms[k] = r.Message[k]
+		}
+
+		return ms
+	}
+
+	return r.Message
+}
+
+func (r *response) keys() []string {
+	seen := make(map[string]bool)
+	ks := []string{}
+
+	add := func(k string) {
+		if !seen[k] {
+			seen[k] = true
+			ks = append(ks, k)
+		}
+	}
+
+	for k := range r.Data {
+		add(k)
+	}
+
+	for k := range r.Meta {
+		add(k)
+	}
+
+	for k := range r.Error {
+		add(k)
+	}
+
+	for k := range r.Message {
+		add(k)
+	}
+
+	return ks
+}
+
+func (r *response) section(m map[string]interface{}, k string, v interface{}, n int) {
+	if n != 0 {
+		m[k] = v
+		return
+	}
+
+	switch r.empty {
+	case SectionNull:
+		m[k] = nil
+	case SectionOmit:
+	default:
+		m[k] = v
+	}
+}
+
+func (r *response) Add(k string, n *json.Node, extra map[string]interface{}) {
+	data := new(interface{})
+	meta := make(map[string]interface{})
+	errs := []Error{}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := n.Get("data").Unmarshal(&data); err == nil {
+		r.Data[k] = data
+	}
+
+	if msg := n.Get("message").String(); msg != "" {
+		r.Message[k] = msg
+	}
+
+	if err := n.Get("meta").Unmarshal(&meta); err == nil {
+		r.Meta[k] = meta
+	}
+
+	if len(extra) != 0 {
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+
+		for s, v := range extra {
+			meta[s] = v
+		}
+
+		r.Meta[k] = meta
+	}
+
+	if err := n.Get("errors").Unmarshal(&errs); err == nil {
+		r.Error[k] = append(r.Error[k], errs...)
+	}
+}
+
+func (r *response) AddError(k string, m Error) {
+	r.mu.Lock()
+	r.Error[k] = append(r.Error[k], m)
+	r.mu.Unlock()
+	r.addStatus(k, m.StatusCode)
+}
+
+func (r *response) Select(k string, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.Data[k].(*interface{}); ok {
+		r.Data[k] = selectFields(*v, fields)
+	}
+}
+
+func (r *response) Validate(k string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := json.Marshal(r.Data[k]); err != nil {
+		return err
+	}
+
+	_, err := json.Marshal(r.Meta[k])
+	return err
+}
+
+func (r *response) Skip(k string) {
+	r.mu.Lock()
+	r.Meta[k] = map[string]interface{}{"skipped": true}
+	r.mu.Unlock()
+}
+
+func (r *response) Drop(k string) {
+	r.mu.Lock()
+	delete(r.Data, k)
+	delete(r.Meta, k)
+	r.mu.Unlock()
+}
+
+func (r *response) Discard() {
+	r.mu.Lock()
+	r.Data = make(map[string]interface{})
+	r.Cache = nil
+	r.mu.Unlock()
+}
+
+func (r *response) AddWarning(k string, ss []string) {
+	if len(ss) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.Warning[k] = append(r.Warning[k], ss...)
+	r.mu.Unlock()
+}
+
+func (r *response) addStatus(k string, code int) {
+	r.mu.Lock()
+	r.Meta[k] = map[string]interface{}{"http_status": code}
+	r.mu.Unlock()
+}
+
+func (r *response) AddMeta(k, name string, v interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.Meta[k].(map[string]interface{}); ok {
+		m[name] = v
+	}
+}
+
+type responseItem struct {
+	Key     string      `json:"key"`
+	Data    interface{} `json:"data"`
+	Message interface{} `json:"message,omitempty"`
+	Meta    interface{} `json:"meta"`
+	Error   []Error     `json:"error"`
+	Warning []string    `json:"warnings,omitempty"`
+}
+
+func (r *response) Items(order map[string]int) []responseItem {
+	ks := sortedKeys(order)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ns := make([]responseItem, 0, len(ks))
+	ms := r.messages()
+
+	for _, k := range ks {
+		var msg interface{}
+
+		if v, ok := ms[k]; ok && (v != "" || r.message == MessageAlways) {
+			msg = v
+		}
+
+		ns = append(ns, responseItem{
+			Key:     k,
+			Data:    r.Data[k],
+			Message: msg,
+			Meta:    r.Meta[k],
+			Error:   r.Error[k],
+			Warning: r.Warning[k],
+		})
+	}
+
+	return ns
+}
+
+func (r *response) Merge(order map[string]int, merge map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var v interface{} = make(map[string]interface{})
+
+	for _, k := range sortedKeys(order) {
+		z, ok := r.Data[k]
+		if !ok {
+			continue
+		}
+
+		if _, obj := dataValue(z).(map[string]interface{}); merge[k] && obj {
+			v = mergePatch(v, dataValue(z))
+		} else {
+			v = mergePatch(v, map[string]interface{}{k: dataValue(z)})
+		}
+	}
+
+	r.Data = v.(map[string]interface{})
+}
+
+func (r *response) MergeInto(order map[string]int, targets map[string]string) {
+	if len(targets) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, k := range sortedKeys(order) {
+		t, ok := targets[k]
+		if !ok {
+			continue
+		}
+
+		z, ok := r.Data[k]
+		if !ok {
+			continue
+		}
+
+		r.Data[t] = mergePatch(r.Data[t], dataValue(z))
+		delete(r.Data, k)
+	}
+}
+
+func sortedKeys(order map[string]int) []string {
+	ks := make([]string, 0, len(order))
+
+	for k := range order {
+		ks = append(ks, k)
+	}
+
+	sort.Slice(ks, func(i, j int) bool {
+		return order[ks[i]] < order[ks[j]]
+	})
+
+	return ks
+}
+
+func newResponse() *response {
+	return &response{
+		Data:    make(map[string]interface{}),
+		Message: make(map[string]string),
+		Meta:    make(map[string]interface{}),
+		Error:   make(map[string][]Error),
+		Warning: make(map[string][]string),
+		mu:      &sync.Mutex{},
+	}
+}
+
+type defaultFinisher struct {
+	Output             OutputMode
+	ResponseHeaderMeta []string
+	StatusPolicy       StatusPolicy
+	TransformResponse  func(key string, body []byte) ([]byte, error)
+	DeprecationMeta    bool
+	ErrCodeFor         func(statusCode int, timeout bool) int
+	CacheHint          bool
+	EmptySections      EmptySection
+	SLOMeta            bool
+	Passthrough        bool
+	Compress           bool
+	CompressMinBytes   int
+	ErrorBodyBytes     int
+	Atomic             bool
+	Envelope           Envelope
+	Summary            bool
+	FinalizeResponse   func(b []byte) []byte
+	SortKeys           bool
+	UniformErrors      bool
+	Messages           MessageMode
+	SniffGzip          bool
+	ValidateBody       func(key string, n *json.Node) error
+}
+
+func (x *defaultFinisher) Finish(w http.ResponseWriter, ms map[string]*http.Response, err error) {
+	b, contentType, code := x.finish(ms, err.(ErrorMulti))
+	w.Header().Set("Content-Type", contentType)
+
+	if x.Compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if enc := x.encoding(x.requests(ms, err.(ErrorMulti)), len(b)); enc != "" {
+			if z, err := compress(enc, b); err == nil {
+				w.Header().Set("Content-Encoding", enc)
+				b = z
+			}
+		}
+	}
+
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func (x *defaultFinisher) FinishErr(w http.ResponseWriter, code int, err error) {
+	b := x.finishErr(code, x.errMessages(err))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func (x *defaultFinisher) errMessages(err error) []string {
+	if err, ok := err.(filterError); ok {
+		return err.Messages()
+	}
+
+	return []string{err.Error()}
+}
+
+func (x *defaultFinisher) finishErr(code int, messages []string) []byte {
+	type Error struct {
+		Message string `json:"message"`
+	}
+
+	if x.UniformErrors {
+		n := newResponse()
+		n.empty = x.EmptySections
+
+		for _, s := range messages {
+			n.Errors = append(n.Errors, aggregateError{Message: s})
+		}
+
+		b, _ := json.Marshal(n)
+		return b
+	}
+
+	type Meta struct {
+		StatusCode int `json:"http_status"`
+	}
+
+	errs := make([]Error, len(messages))
+
+	for i, s := range messages {
+		errs[i] = Error{Message: s}
+	}
+
+	b, _ := json.Marshal(struct {
+		Errors []Error `json:"errors"`
+		Meta   Meta    `json:"meta"`
+	}{
+		Errors: errs,
+		Meta:   Meta{StatusCode: code},
+	})
+
+	return b
+}
+
+func (x *defaultFinisher) finish(ms map[string]*http.Response, me ErrorMulti) ([]byte, string, int) {
+	ms, me = x.rename(ms, me)
+	ns, es := x.beforeFinish(ms)
+
+	n := newResponse()
+	n.empty = x.EmptySections
+	n.message = x.Messages
+
+	for k, err := range me {
+		n.AddError(k, x.wrapError(err))
+
+		if err, ok := err.(Error); ok && err.request != nil {
+			if h, ok := echoedHeaders(err.request); ok {
+				n.AddMeta(k, "request_headers", h)
+			}
+		}
+	}
+
+	for k, err := range es {
+		n.AddError(k, x.wrapError(err))
+
+		if h, ok := echoedHeaders(ms[k].Request); ok {
+			n.AddMeta(k, "request_headers", h)
+		}
+
+		if s, ok := retryAfter(ms[k]); ok {
+			n.AddMeta(k, "retry_after_seconds", s)
+		}
+	}
+
+	for k, z := range ns {
+		if aggregateSkipped(ms[k].Request) {
+			n.Skip(k)
+			continue
+		}
+
+		n.Add(k, z, x.metaExtra(ms[k]))
+		n.Select(k, aggregateFields(ms[k].Request))
+	}
+
+	x.isolate(n, ms)
+
+	rq := x.requests(ms, me)
+
+	for k, r := range rq {
+		n.AddWarning(k, aggregateWarnings(r))
+	}
+
+	if x.Output != OutputArray {
+		n.MergeInto(x.order(rq), x.mergeTargets(rq))
+	}
+
+	if x.CacheHint {
+		n.Cache = x.cacheHint(ms, me, rq)
+	}
+
+	code := x.statusCode(len(ms)+len(me), n, me)
+
+	var discarded bool
+
+	if x.Atomic {
+		if failed, timeout := x.failures(n, me); failed != 0 {
+			n.Discard()
+			code = StatusAllFailed(failed, failed, timeout)
+			discarded = true
+		}
+	}
+
+	if x.Summary {
+		n.Summary = newSummary(n, ms, me, rq, discarded)
+	}
+
+	var v interface{} = n
+
+	switch x.Output {
+	case OutputArray:
+		v = n.Items(x.order(rq))
+	case OutputMerged:
+		n.Merge(x.order(rq), x.merged(rq))
+	}
+
+	b, _ := json.Marshal(v)
+
+	if x.SortKeys {
+		b = sortKeys(b)
+	}
+
+	if x.FinalizeResponse != nil {
+		b = x.FinalizeResponse(b)
+	}
+
+	if x.acceptXML(rq) {
+		z, err := marshalXML("response", b)
+		if err != nil {
+			return x.finishErr(http.StatusInternalServerError, []string{errEncodeXML.Error()}), "application/json", http.StatusInternalServerError
+		}
+
+		return z, "application/xml", code
+	}
+
+	return b, "application/json", code
+}
+
+func sortKeys(b []byte) []byte {
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return b
+	}
+
+	z, err := json.Marshal(v)
+	if err != nil {
+		return b
 	}
 
-	body := bytes.NewReader(t.Bytes())
-	req.Body = ioutil.NopCloser(body)
-	req.ContentLength = int64(body.Len())
-
-	return req
+	return z
 }
 
-type defaultFetcher struct {
-	FetchLatency func(n time.Duration, method, routePattern string, statusCode int)
-	FetchLogger  func(n time.Duration, method, urlPath string, statusCode int, reqID string)
+func (x *defaultFinisher) isolate(n *response, ms map[string]*http.Response) {
+	for k, res := range ms {
+		if err := n.Validate(k); err != nil {
+			n.Drop(k)
+			n.AddError(k, x.wrapError(x.buildError(res, err.Error(), http.StatusInternalServerError)))
+		}
+	}
 }
 
-func (x *defaultFetcher) Fetch(mr map[string]*http.Request, z http.RoundTripper) (map[string]*http.Response, error) {
-	var wg sync.WaitGroup
+func (x *defaultFinisher) decode(ms map[string]*http.Response, me ErrorMulti, key string, v interface{}) error {
+	for k, res := range ms {
+		if k != key {
+			res.Body.Close()
+		}
+	}
 
-	mu := &sync.Mutex{}
-	ms := make(map[string]*http.Response)
-	es := make(ErrorMulti)
+	if err, ok := me[key]; ok {
+		return x.wrapError(err)
+	}
 
-	wg.Add(len(mr))
+	res := ms[key]
 
-	for k, v := range mr {
-		go func(s string, r *http.Request) {
-			start := time.Now()
-			res, err := x.fetch(r, z)
+	if aggregateSkipped(res.Request) {
+		res.Body.Close()
+		return errSkippedKey
+	}
 
-			mu.Lock()
+	ns, es := x.beforeFinish(map[string]*http.Response{key: res})
 
-			dur := time.Since(start)
-			x.fetchLatency(dur, r, res)
-			x.fetchLogger(dur, r, res)
+	if err, ok := es[key]; ok {
+		return x.wrapError(err)
+	}
 
-			if err != nil {
-				es[s] = x.buildError(r, err)
-			} else {
-				ms[s] = res
-			}
+	n := ns[key]
 
-			mu.Unlock()
-			wg.Done()
-		}(k, v)
+	if x.hasErrorBody(n) {
+		msg := n.Get("errors").GetN(0).Get("message").String()
+		return x.wrapError(x.buildError(res, msg, res.StatusCode))
 	}
 
-	wg.Wait()
-
-	return ms, es
+	return n.Get("data").Unmarshal(v)
 }
 
-func (x *defaultFetcher) fetchLatency(n time.Duration, r *http.Request, res *http.Response) {
-	x.FetchLatency(n, r.Method, x.routePattern(res), x.statusCode(r, res))
-}
+func (x *defaultFinisher) rename(ms map[string]*http.Response, me ErrorMulti) (map[string]*http.Response, ErrorMulti) {
+	rs := make(map[string]*http.Response, len(ms))
+	es := make(ErrorMulti, len(me))
 
-func (x *defaultFetcher) fetchLogger(n time.Duration, r *http.Request, res *http.Response) {
-	x.FetchLogger(n, r.Method, r.URL.Path, x.statusCode(r, res), r.Header.Get("X-Request-Id"))
-}
+	for k, res := range ms {
+		rs[outputKey(k, res.Request)] = res
+	}
 
-func (x *defaultFetcher) statusCode(r *http.Request, res *http.Response) int {
-	if res != nil {
-		return res.StatusCode
+	for k, err := range me {
+		if err, ok := err.(Error); ok && err.request != nil {
+			k = outputKey(k, err.request)
+		}
+
+		es[k] = err
 	}
 
-	return http.StatusBadGateway
+	return rs, es
 }
 
-func (x *defaultFetcher) routePattern(res *http.Response) string {
-	if res != nil {
-		return res.Header.Get("X-Route-Pattern")
+func outputKey(k string, r *http.Request) string {
+	if s := subRequestOf(r).as; s != "" {
+		return s
 	}
 
-	return ""
+	return k
 }
 
-func (x *defaultFetcher) fetch(r *http.Request, z http.RoundTripper) (*http.Response, error) {
-	if r.Header.Get("X-Invalid") != "" {
-		return x.localResponse(r)
-	}
+func distinctMergeTargets(a aggregate) bool {
+	keys := make(map[string]bool, len(a))
 
-	var t time.Duration
+	for k, v := range a {
+		if v.As != "" {
+			k = v.As
+		}
 
-	if n, err := time.ParseDuration(r.Header.Get("X-Timeout")); err == nil {
-		t = n
+		keys[k] = true
 	}
 
-	htc := &http.Client{
-		Timeout:   t,
-		Transport: z,
+	for _, v := range a {
+		if v.MergeInto != "" && keys[v.MergeInto] {
+			return false
+		}
 	}
 
-	return htc.Do(r)
-}
-
-func (x *defaultFetcher) localResponse(r *http.Request) (*http.Response, error) {
-	body := x.buildError(r, errors.New("Not Found")).Error()
-
-	return &http.Response{
-		Proto:         "HTTP/1.1",
-		ProtoMajor:    1,
-		ProtoMinor:    1,
-		Status:        fmt.Sprintf("%03d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
-		StatusCode:    http.StatusNotFound,
-		Request:       r,
-		Header:        make(http.Header),
-		Body:          ioutil.NopCloser(strings.NewReader(body)),
-		ContentLength: int64(len(body)),
-	}, nil
+	return true
 }
 
-func (x *defaultFetcher) buildError(req *http.Request, err error) error {
-	message := err.Error()
-	statusErrCode := http.StatusBadGateway
+func uniqueOutputKeys(a aggregate) bool {
+	seen := make(map[string]bool, len(a))
 
-	var errTimeout bool
+	for k, v := range a {
+		if v.As != "" {
+			k = v.As
+		}
 
-	if err, ok := err.(net.Error); ok {
-		if err.Timeout() {
-			errTimeout = true
-			message = "timeout of " + req.Header.Get("X-Timeout") + " exceeded"
-		} else {
-			message = err.(*url.Error).Err.Error()
+		if seen[k] {
+			return false
 		}
-	}
 
-	return Error{
-		Path:       req.URL.Path,
-		Method:     req.Method,
-		Message:    message,
-		StatusCode: statusErrCode,
-		ErrCode:    10000,
-		ErrTimeout: errTimeout,
+		seen[k] = true
 	}
-}
 
-type response struct {
-	mu      *sync.Mutex
-	Data    map[string]interface{} `json:"data"`
-	Message map[string]string      `json:"message,omitempty"`
-	Meta    map[string]interface{} `json:"meta"`
-	Error   map[string][]Error     `json:"error"`
+	return true
 }
 
-func (r *response) Add(k string, n *json.Node) {
-	data := new(interface{})
-	meta := make(map[string]interface{})
-	errs := []Error{}
-
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (x *defaultFinisher) requests(ms map[string]*http.Response, me ErrorMulti) map[string]*http.Request {
+	m := make(map[string]*http.Request)
 
-	if err := n.Get("data").Unmarshal(&data); err == nil {
-		r.Data[k] = data
+	for k, res := range ms {
+		m[k] = res.Request
 	}
 
-	if msg := n.Get("message").String(); msg != "" {
-		r.Message[k] = msg
+	for k, err := range me {
+		if err, ok := err.(Error); ok && err.request != nil {
+			m[k] = err.request
+		}
 	}
 
-	if err := n.Get("meta").Unmarshal(&meta); err == nil {
-		r.Meta[k] = meta
+	return m
+}
+
+func (x *defaultFinisher) encoding(rq map[string]*http.Request, size int) string {
+	if size < x.CompressMinBytes {
+		return ""
 	}
 
-	if err := n.Get("errors").Unmarshal(&errs); err == nil {
-		r.Error[k] = append(r.Error[k], errs...)
+	r := anyRequest(rq)
+	if r == nil {
+		return ""
 	}
-}
 
-func (r *response) AddError(k string, m Error) {
-	r.mu.Lock()
-	r.Error[k] = append(r.Error[k], m)
-	r.mu.Unlock()
-	r.addStatus(k, m.StatusCode)
+	s, _ := r.Context().Value(acceptEncodingKey{}).(string)
+	return acceptedEncoding(s)
 }
 
-func (r *response) addStatus(k string, code int) {
-	type meta struct {
-		StatusCode int `json:"http_status"`
+func (x *defaultFinisher) acceptXML(rq map[string]*http.Request) bool {
+	r := anyRequest(rq)
+	if r == nil {
+		return false
 	}
 
-	r.mu.Lock()
-	r.Meta[k] = meta{StatusCode: code}
-	r.mu.Unlock()
+	s, _ := r.Context().Value(acceptKey{}).(string)
+	return prefersXML(s)
 }
 
-func newResponse() *response {
-	return &response{
-		Data:    make(map[string]interface{}),
-		Message: make(map[string]string),
-		Meta:    make(map[string]interface{}),
-		Error:   make(map[string][]Error),
-		mu:      &sync.Mutex{},
+func (x *defaultFinisher) statusCode(total int, n *response, me ErrorMulti) int {
+	if x.StatusPolicy == nil {
+		return http.StatusOK
 	}
+
+	failed, timeout := x.failures(n, me)
+	return x.StatusPolicy(total, failed, timeout)
 }
 
-type defaultFinisher struct{}
+func (x *defaultFinisher) failures(n *response, me ErrorMulti) (int, int) {
+	var failed, timeout int
 
-func (x *defaultFinisher) Finish(w http.ResponseWriter, ms map[string]*http.Response, err error) {
-	b := x.finish(ms, err.(ErrorMulti))
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
-}
+	for _, errs := range n.Error {
+		if len(errs) != 0 {
+			failed++
+		}
+	}
 
-func (x *defaultFinisher) FinishErr(w http.ResponseWriter, code int, err error) {
-	b := x.finishErr(code, err.Error())
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(b)
+	for _, err := range me {
+		if err, ok := err.(Error); ok && err.ErrTimeout {
+			timeout++
+		}
+	}
+
+	return failed, timeout
 }
 
-func (x *defaultFinisher) finishErr(code int, message string) []byte {
-	type Error struct {
-		Message string `json:"message"`
+func (x *defaultFinisher) cacheHint(ms map[string]*http.Response, me ErrorMulti, rq map[string]*http.Request) *cacheHint {
+	r := anyRequest(rq)
+	if r == nil {
+		return nil
 	}
 
-	type Meta struct {
-		StatusCode int `json:"http_status"`
+	z := &cacheHint{Key: subRequestOf(r).cacheKey, TTL: -1}
+
+	for _, res := range ms {
+		n := int(maxAge(res.Header) / time.Second)
+
+		if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+			n = 0
+		}
+
+		if z.TTL < 0 || n < z.TTL {
+			z.TTL = n
+		}
 	}
 
-	b, _ := json.Marshal(struct {
-		Errors []Error `json:"errors"`
-		Meta   Meta    `json:"meta"`
-	}{
-		Errors: []Error{{Message: message}},
-		Meta:   Meta{StatusCode: code},
-	})
+	if z.TTL < 0 || len(me) != 0 {
+		z.TTL = 0
+	}
 
-	return b
+	return z
 }
 
-func (x *defaultFinisher) finish(ms map[string]*http.Response, me ErrorMulti) []byte {
-	ns, es := x.beforeFinish(ms)
-
-	n := newResponse()
+func (x *defaultFinisher) order(rq map[string]*http.Request) map[string]int {
+	m := make(map[string]int)
 
-	for k, err := range me {
-		n.AddError(k, x.wrapError(err))
+	for k, r := range rq {
+		m[k] = aggregateIndex(r)
 	}
 
-	for k, err := range es {
-		n.AddError(k, x.wrapError(err))
+	return m
+}
+
+func (x *defaultFinisher) mergeTargets(rq map[string]*http.Request) map[string]string {
+	m := make(map[string]string)
+
+	for k, r := range rq {
+		if s := aggregateMergeInto(r); s != "" {
+			m[k] = s
+		}
 	}
 
-	for k, z := range ns {
-		n.Add(k, z)
+	return m
+}
+
+func (x *defaultFinisher) merged(rq map[string]*http.Request) map[string]bool {
+	m := make(map[string]bool)
+
+	for k, r := range rq {
+		m[k] = aggregateMerge(r)
 	}
 
-	b, _ := json.Marshal(n)
-	return b
+	return m
 }
 
 func (x *defaultFinisher) beforeFinish(ms map[string]*http.Response) (map[string]*json.Node, ErrorMulti) {
@@ -463,6 +2691,15 @@ func (x *defaultFinisher) beforeFinish(ms map[string]*http.Response) (map[string
 			continue
 		}
 
+		if x.TransformResponse != nil {
+			if b, err = x.TransformResponse(k, b); err != nil {
+				es[k] = x.buildError(res, err.Error(), http.StatusBadGateway)
+				continue
+			}
+		}
+
+		b = x.Envelope.normalize(b)
+
 		n := json.NewNode(bytes.NewReader(b))
 
 		if x.hasErrorBody(n) {
@@ -470,8 +2707,23 @@ func (x *defaultFinisher) beforeFinish(ms map[string]*http.Response) (map[string
 			continue
 		}
 
-		if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
-			es[k] = x.buildError(res, res.Status, res.StatusCode)
+		if res.StatusCode == http.StatusNotModified {
+			ns[k] = json.NewNode(strings.NewReader("{}"))
+			continue
+		}
+
+		if !expectedStatus(res) {
+			es[k] = x.withDetail(x.buildError(res, res.Status, res.StatusCode), b)
+			continue
+		}
+
+		if !n.IsValid() && isBodiless(res, b) {
+			ns[k] = json.NewNode(strings.NewReader("{}"))
+			continue
+		}
+
+		if !n.IsValid() && x.passthrough(res) {
+			ns[k] = passthroughNode(res, b)
 			continue
 		}
 
@@ -480,28 +2732,67 @@ func (x *defaultFinisher) beforeFinish(ms map[string]*http.Response) (map[string
 			continue
 		}
 
+		if x.ValidateBody != nil {
+			if err := x.ValidateBody(k, n); err != nil {
+				es[k] = x.buildError(res, err.Error(), http.StatusBadGateway)
+				continue
+			}
+		}
+
 		ns[k] = n
 	}
 
 	return ns, es
 }
 
-func (x *defaultFinisher) readBody(res *http.Response) ([]byte, error) {
-	var rbc io.ReadCloser
+func (x *defaultFinisher) passthrough(res *http.Response) bool {
+	return x.Passthrough || subRequestOf(res.Request).passthrough
+}
 
-	switch res.Header.Get("Content-Encoding") {
-	case "gzip":
-		gz, err := gzip.NewReader(res.Body)
-		if err != nil {
-			return nil, x.buildError(res, err.Error(), http.StatusInternalServerError)
-		}
+func passthroughNode(res *http.Response, b []byte) *json.Node {
+	v := map[string]interface{}{
+		"data": string(b),
+		"meta": map[string]string{"content_type": res.Header.Get("Content-Type")},
+	}
 
-		rbc = gz
-	default:
-		rbc = res.Body
+	z, _ := json.Marshal(v)
+	return json.NewNode(bytes.NewReader(z))
+}
+
+func isBodiless(res *http.Response, b []byte) bool {
+	if len(bytes.TrimSpace(b)) != 0 {
+		return false
+	}
+
+	if len(aggregateExpect(res.Request)) != 0 {
+		return true
 	}
 
-	defer rbc.Close()
+	switch res.Request.Method {
+	case http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return res.StatusCode == http.StatusNoContent
+}
+
+func (x *defaultFinisher) readBody(res *http.Response) ([]byte, error) {
+	var rbc io.Reader = res.Body
+
+	if enc := res.Header.Get("Content-Encoding"); enc == "gzip" || (x.SniffGzip && enc == "") {
+		br := bufio.NewReader(res.Body)
+		rbc = br
+
+		if isGzip(br) {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return nil, x.buildError(res, err.Error(), http.StatusInternalServerError)
+			}
+
+			defer gz.Close()
+			rbc = gz
+		}
+	}
 
 	b, err := ioutil.ReadAll(rbc)
 	if err != nil {
@@ -511,6 +2802,94 @@ func (x *defaultFinisher) readBody(res *http.Response) ([]byte, error) {
 	return b, nil
 }
 
+func isGzip(br *bufio.Reader) bool {
+	b, err := br.Peek(2)
+	return err == nil && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func (x *defaultFinisher) metaExtra(res *http.Response) map[string]interface{} {
+	m := map[string]interface{}{
+		"http_status": res.StatusCode,
+	}
+
+	if h := x.metaHeaders(res); len(h) != 0 {
+		m["headers"] = h
+	}
+
+	if h, ok := echoedHeaders(res.Request); ok {
+		m["request_headers"] = h
+	}
+
+	if x.DeprecationMeta {
+		if d := parseDeprecation(res.Header); d != nil {
+			m["deprecation"] = d
+		}
+	}
+
+	if s, ok := retryAfter(res); ok {
+		m["retry_after_seconds"] = s
+	}
+
+	if res.StatusCode == http.StatusNotModified {
+		m["not_modified"] = true
+
+		if s := res.Header.Get("ETag"); s != "" {
+			m["etag"] = s
+		}
+	}
+
+	if x.SLOMeta && subRequestOf(res.Request).sloBreach {
+		m["slo_breach"] = true
+	}
+
+	return m
+}
+
+func echoedHeaders(r *http.Request) (http.Header, bool) {
+	if r.Context().Value(echoHeadersKey{}) == nil {
+		return nil, false
+	}
+
+	return redactHeaders(r.Header), true
+}
+
+func redactHeaders(rh http.Header) http.Header {
+	h := make(http.Header, len(rh))
+
+	for k, v := range rh {
+		switch {
+		case internalHeader(k):
+		case sensitiveHeader(k):
+			h[k] = []string{"[REDACTED]"}
+		default:
+			h[k] = v
+		}
+	}
+
+	return h
+}
+
+func sensitiveHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case "Authorization", "Proxy-Authorization", "Cookie":
+		return true
+	}
+
+	return false
+}
+
+func (x *defaultFinisher) metaHeaders(res *http.Response) map[string]string {
+	m := make(map[string]string)
+
+	for _, s := range x.ResponseHeaderMeta {
+		if v := res.Header.Get(s); v != "" {
+			m[http.CanonicalHeaderKey(s)] = v
+		}
+	}
+
+	return m
+}
+
 func (x *defaultFinisher) hasErrorBody(n *json.Node) bool {
 	return n.Get("errors").Len() > 0
 }
@@ -519,7 +2898,7 @@ func (x *defaultFinisher) buildError(res *http.Response, msg string, code int) e
 	err := Error{
 		Path:       res.Request.URL.Path,
 		Method:     res.Request.Method,
-		ErrCode:    10000,
+		ErrCode:    errCode(x.ErrCodeFor, code, false),
 		StatusCode: code,
 		Message:    msg,
 	}
@@ -527,6 +2906,27 @@ func (x *defaultFinisher) buildError(res *http.Response, msg string, code int) e
 	return err
 }
 
+func (x *defaultFinisher) withDetail(err error, b []byte) error {
+	if x.ErrorBodyBytes <= 0 {
+		return err
+	}
+
+	b = bytes.TrimSpace(b)
+
+	if len(b) > x.ErrorBodyBytes {
+		b = b[:x.ErrorBodyBytes]
+
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(b); i++ {
+			b = b[:len(b)-1]
+		}
+	}
+
+	erc := err.(Error)
+	erc.Detail = string(b)
+
+	return erc
+}
+
 func (x *defaultFinisher) wrapError(err error) Error {
 	er2 := err.(Error)
 	erc := er2
@@ -1,11 +1,28 @@
 package buffon_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bukalapak/buffon"
+	"github.com/bukalapak/ottoman/encoding/json"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,6 +35,157 @@ func TestDefaultExecutor(t *testing.T) {
 	})
 }
 
+func TestDefaultExecutor_HTTPSOnly(t *testing.T) {
+	t.Run("plaintext-backend", func(t *testing.T) {
+		opt := &buffon.DefaultOption{HTTPSOnly: true}
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Equal(t, "Backend must use HTTPS", err.Error())
+		assert.Nil(t, exc)
+	})
+
+	t.Run("plaintext-service", func(t *testing.T) {
+		u, _ := url.Parse("http://other.dev")
+
+		opt := &buffon.DefaultOption{
+			HTTPSOnly: true,
+			Services:  map[string]*url.URL{"other": u},
+		}
+
+		exc, err := buffon.NewDefaultExecutor("https://backend.dev", opt)
+		assert.Equal(t, "Backend must use HTTPS", err.Error())
+		assert.Nil(t, exc)
+	})
+
+	t.Run("https-backend", func(t *testing.T) {
+		opt := &buffon.DefaultOption{HTTPSOnly: true}
+		exc, err := buffon.NewDefaultExecutor("https://backend.dev", opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "https", m["x1"].URL.Scheme)
+		assert.Equal(t, "", m["x1"].Header.Get("X-Invalid"))
+	})
+}
+
+func TestDefaultExecutor_TimeoutJitter(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		Timeout:       100 * time.Millisecond,
+		MaxTimeout:    110 * time.Millisecond,
+		TimeoutJitter: 0.5,
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	seen := make(map[time.Duration]bool)
+
+	for i := 0; i < 50; i++ {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+
+		n, err := time.ParseDuration(m["x1"].Header.Get("X-Timeout"))
+		assert.Nil(t, err)
+		assert.True(t, n >= 50*time.Millisecond && n <= 110*time.Millisecond)
+
+		seen[n] = true
+	}
+
+	assert.True(t, len(seen) > 1)
+}
+
+func TestDefaultExecutor_DeadlineHeader(t *testing.T) {
+	data := []struct {
+		header string
+		value  string
+		x1     string
+		x2     string
+	}{
+		{"Grpc-Timeout", "", "2s", "300ms"},
+		{"Grpc-Timeout", "500m", "500ms", "300ms"},
+		{"Grpc-Timeout", "1H", "2s", "300ms"},
+		{"Grpc-Timeout", "5x", "2s", "300ms"},
+		{"X-Request-Deadline", "250", "250ms", "250ms"},
+		{"X-Request-Deadline", "1.5s", "1.5s", "300ms"},
+	}
+
+	for _, x := range data {
+		opt := &buffon.DefaultOption{
+			Timeout:        2 * time.Second,
+			MaxTimeout:     5 * time.Second,
+			DeadlineHeader: x.header,
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"},"x2":{"path":"/bar","timeout":300}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		if x.value != "" {
+			r.Header.Set(x.header, x.value)
+		}
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Equal(t, x.x1, m["x1"].Header.Get("X-Timeout"))
+		assert.Equal(t, x.x2, m["x2"].Header.Get("X-Timeout"))
+	}
+
+	opt := &buffon.DefaultOption{DeadlineHeader: "X-Request-Deadline"}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r.Header.Set("X-Request-Deadline", time.Now().Add(-time.Second).Format(time.RFC3339Nano))
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.JSONEq(t, `{"errors":[{"message":"Upstream deadline exceeded"}],"meta":{"http_status":504}}`, w.Body.String())
+}
+
+func TestDefaultExecutor_StrictEnvelope(t *testing.T) {
+	data := []struct {
+		strict bool
+		body   string
+		code   int
+		result string
+	}{
+		{false, `{"aggregat":{"x1":{"path":"/foo"}}}`, http.StatusOK, `{"data":{},"meta":{},"error":{}}`},
+		{true, `{"aggregat":{"x1":{"path":"/foo"}}}`, http.StatusBadRequest, `{"errors":[{"message":"Unknown aggregate field \"aggregat\""}],"meta":{"http_status":400}}`},
+		{true, `{"aggregate":{},"body":{"id":1}}`, http.StatusOK, `{"data":{},"meta":{},"error":{}}`},
+	}
+
+	for _, x := range data {
+		opt := &buffon.DefaultOption{
+			StrictEnvelope: x.strict,
+			FetchLatency:   NoopFetchLatency,
+			FetchLogger:    NoopFetchLogger,
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(x.body))
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, x.code, w.Code)
+		assert.JSONEq(t, x.result, w.Body.String())
+	}
+}
+
 func TestDefaultExecutor_MaxRequest(t *testing.T) {
 	opt := &buffon.DefaultOption{
 		MaxRequest: 1,
@@ -33,3 +201,1066 @@ func TestDefaultExecutor_MaxRequest(t *testing.T) {
 	assert.Equal(t, "Too many aggregate requests", err.Error())
 	assert.Nil(t, m)
 }
+
+func TestDefaultExecutor_RejectEmpty(t *testing.T) {
+	data := []struct {
+		reject bool
+		code   int
+		body   string
+	}{
+		{false, http.StatusOK, `{"data":{},"meta":{},"error":{}}`},
+		{true, http.StatusBadRequest, `{"errors":[{"message":"Aggregate must not be empty"}],"meta":{"http_status":400}}`},
+	}
+
+	for _, x := range data {
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{RejectEmpty: x.reject})
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(`{"aggregate":{}}`))
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, x.code, w.Code)
+		assert.JSONEq(t, x.body, w.Body.String())
+	}
+}
+
+func TestDefaultExecutor_MaxTimeoutBudget(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		Timeout:          time.Second,
+		MaxTimeout:       3 * time.Second,
+		MaxTimeoutBudget: 4 * time.Second,
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	data := []struct {
+		body string
+		err  string
+	}{
+		{`{"aggregate":{"x1":{"path":"/foo"},"x2":{"path":"/bar","timeout":3000}}}`, ""},
+		{`{"aggregate":{"x1":{"path":"/foo"},"x2":{"path":"/bar","timeout":9000},"x3":{"path":"/baz"}}}`, "Aggregate exceeds the timeout budget"},
+	}
+
+	for _, x := range data {
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(x.body))
+
+		m, err := exc.Build(r)
+		if x.err == "" {
+			assert.Nil(t, err)
+			assert.Len(t, m, 2)
+			continue
+		}
+
+		assert.Equal(t, x.err, err.Error())
+		assert.Nil(t, m)
+	}
+}
+
+func TestDefaultExecutor_UniformErrors(t *testing.T) {
+	data := []struct {
+		opt  *buffon.DefaultOption
+		body string
+	}{
+		{
+			&buffon.DefaultOption{MaxRequest: 1},
+			`{"errors":[{"message":"Too many aggregate requests"}],"meta":{"http_status":400}}`,
+		},
+		{
+			&buffon.DefaultOption{MaxRequest: 1, UniformErrors: true},
+			`{"data":{},"meta":{},"error":{},"errors":[{"message":"Too many aggregate requests"}]}`,
+		},
+		{
+			&buffon.DefaultOption{MaxRequest: 1, UniformErrors: true, EmptySections: buffon.SectionOmit},
+			`{"errors":[{"message":"Too many aggregate requests"}]}`,
+		},
+	}
+
+	for _, x := range data {
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", x.opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"},"x2":{"path":"/bar"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, x.body, w.Body.String())
+	}
+}
+
+type QueryBuilder struct {
+	BaseURL string
+}
+
+func (b QueryBuilder) Build(r *http.Request) (map[string]*http.Request, error) {
+	mr := make(map[string]*http.Request)
+
+	for _, k := range strings.Split(r.URL.Query().Get("keys"), ",") {
+		req, err := http.NewRequest("GET", b.BaseURL+"/"+k, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		mr[k] = req
+	}
+
+	return mr, nil
+}
+
+type PlainFinisher struct{}
+
+func (PlainFinisher) Finish(w http.ResponseWriter, ms map[string]*http.Response, err error) {
+	for _, res := range ms {
+		res.Body.Close()
+	}
+
+	fmt.Fprintf(w, "%d responses", len(ms))
+}
+
+func (PlainFinisher) FinishErr(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	fmt.Fprint(w, err.Error())
+}
+
+func TestDefaultExecutor_CustomStages(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":{"path":%q}}`, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		Builder:      QueryBuilder{BaseURL: backend.URL},
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "http://example.com/aggregate?keys=a,b", nil)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{"a":{"path":"/a"},"b":{"path":"/b"}},"meta":{"a":{"http_status":200},"b":{"http_status":200}},"error":{}}`, w.Body.String())
+
+	opt.Finisher = PlainFinisher{}
+
+	exc, err = buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	r = httptest.NewRequest("GET", "http://example.com/aggregate?keys=a,b", nil)
+	w = httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2 responses", w.Body.String())
+}
+
+func TestDefaultExecutor_Messages(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"data":{"id":1},"message":"Found"}`))
+		case "/fail":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"errors":[{"code":1,"message":"Invalid"}],"message":"Rejected"}`))
+		default:
+			w.Write([]byte(`{"data":{"id":2}}`))
+		}
+	}))
+	defer backend.Close()
+
+	data := []struct {
+		mode    buffon.MessageMode
+		message map[string]string
+	}{
+		{buffon.MessageDefault, map[string]string{"x1": "Found", "x2": "Rejected"}},
+		{buffon.MessageAlways, map[string]string{"x1": "Found", "x2": "Rejected", "x3": ""}},
+		{buffon.MessageOmit, nil},
+		{buffon.MessageOnError, map[string]string{"x2": "Rejected"}},
+	}
+
+	for _, x := range data {
+		opt := &buffon.DefaultOption{
+			Messages:     x.mode,
+			FetchLatency: NoopFetchLatency,
+			FetchLogger:  NoopFetchLogger,
+		}
+
+		exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/ok"},"x2":{"path":"/fail"},"x3":{"path":"/plain"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		v := struct {
+			Message map[string]string `json:"message"`
+		}{}
+
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &v))
+		assert.Equal(t, x.message, v.Message)
+	}
+}
+
+func TestDefaultExecutor_SniffGzip(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"data":{"hello":"gzip!"}}`))
+		gz.Close()
+	}))
+	defer backend.Close()
+
+	data := []struct {
+		sniff bool
+		body  string
+	}{
+		{false, `{"data":{},"meta":{"x1":{"http_status":415}},"error":{"x1":[{"code":10000,"message":"GET /undeclared: Unsupported Media Type"}]}}`},
+		{true, `{"data":{"x1":{"hello":"gzip!"}},"meta":{"x1":{"http_status":200}},"error":{}}`},
+	}
+
+	for _, x := range data {
+		opt := &buffon.DefaultOption{
+			SniffGzip:    x.sniff,
+			FetchLatency: NoopFetchLatency,
+			FetchLogger:  NoopFetchLogger,
+		}
+
+		exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/undeclared"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.JSONEq(t, x.body, w.Body.String())
+	}
+}
+
+func TestDefaultExecutor_Mocks(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		Mocks: map[string]buffon.Mock{
+			"/users/1":         {Body: `{"data":{"id":1}}`},
+			"DELETE /users/1":  {StatusCode: http.StatusNoContent},
+			"/products/broken": {StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"5"}}},
+		},
+		Transport:    &FailureTransport{},
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/users/1"},"x2":{"method":"DELETE","path":"/users/1"},"x3":{"path":"/products/broken"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.JSONEq(t, `{
+		"data": {"x1": {"id": 1}},
+		"meta": {"x1": {"http_status": 200}, "x2": {"http_status": 204}, "x3": {"http_status": 503, "retry_after_seconds": 5}},
+		"error": {"x3": [{"code": 10000, "message": "GET /products/broken: 503 Service Unavailable"}]}
+	}`, w.Body.String())
+}
+
+func TestDefaultExecutor_BasePath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"path":"` + r.URL.EscapedPath() + `"}}`))
+	}))
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	for _, base := range []string{"/api", "/api/"} {
+		exc, err := buffon.NewDefaultExecutor(backend.URL+base, opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/users/1"},"x2":{"path":"users"},"x3":{"path":"/files/a%2Fb"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.JSONEq(t, `{
+			"data": {"x1": {"path": "/api/users/1"}, "x2": {"path": "/api/users"}, "x3": {"path": "/api/files/a%2Fb"}},
+			"error": {},
+			"meta": {"x1": {"http_status": 200}, "x2": {"http_status": 200}, "x3": {"http_status": 200}}
+		}`, w.Body.String())
+	}
+}
+
+func TestDefaultExecutor_ErrorRates(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if strings.HasPrefix(r.URL.Path, "/users/") {
+			w.Header().Set("X-Route-Pattern", "/users/:id")
+		}
+
+		if r.URL.Path == "/users/2" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		ErrorRateWindow: time.Minute,
+		FetchLatency:    NoopFetchLatency,
+		FetchLogger:     NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{
+		"x1":{"path":"/users/1"},"x2":{"path":"/users/2"},"x3":{"path":"/users/3"},"x4":{"path":"http://example.com/"},
+		"y1":{"path":"/random/1"},"y2":{"path":"/random/2"}
+	}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	rates := exc.ErrorRates()
+	assert.Equal(t, map[string]buffon.ErrorRate{"GET /users/:id": {Requests: 3, Failures: 1}, "unmatched": {Requests: 2}}, rates)
+	assert.InDelta(t, 1.0/3, rates["GET /users/:id"].Rate(), 0.001)
+
+	now := time.Now()
+
+	rates = buffon.ErrorRatesAt(time.Minute, map[time.Time]bool{
+		now.Add(-2 * time.Minute):  true,
+		now.Add(-30 * time.Second): true,
+		now.Add(-time.Second):      false,
+		now:                        false,
+	}, now)
+
+	assert.Equal(t, map[string]buffon.ErrorRate{"GET /users/:id": {Requests: 3, Failures: 1}}, rates)
+
+	routes := buffon.ErrorRoutesAt(time.Minute, []buffon.RateRecord{
+		{Route: "GET /idle", At: now.Add(-2 * time.Hour)},
+		{Route: "GET /busy", At: now.Add(-time.Minute)},
+		{Route: "GET /busy", At: now},
+	})
+
+	assert.Equal(t, []string{"GET /busy"}, routes)
+}
+
+func TestDefaultExecutor_MaxRequestBytes(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		MaxRequestBytes: 40,
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	t.Run("too-large", func(t *testing.T) {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"},"x2":{"path":"/bar"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), "Aggregate request is too large")
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		data := []struct {
+			body     string
+			code     int
+			expected string
+		}{
+			{"--xyz\r\nContent-Disposition: form-data; name=\"aggregate\"\r\n\r\n" + strings.Repeat("x", 64) + "\r\n--xyz--\r\n", http.StatusRequestEntityTooLarge, "Aggregate request is too large"},
+			{"garbage", http.StatusBadRequest, "Must provide aggregate query"},
+		}
+
+		for _, x := range data {
+			r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(x.body))
+			r.Header.Set("Content-Type", "multipart/form-data; boundary=xyz")
+			w := httptest.NewRecorder()
+
+			buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+			assert.Equal(t, x.code, w.Code)
+			assert.Contains(t, w.Body.String(), x.expected)
+		}
+	})
+
+	t.Run("within-limit", func(t *testing.T) {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Len(t, m, 1)
+	})
+}
+
+func TestDefaultExecutor_KeyPattern(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		KeyPattern: regexp.MustCompile(`^[a-z][a-z0-9_]*$`),
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	t.Run("invalid", func(t *testing.T) {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"},"x.2":{"path":"/bar"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"errors":[{"message":"Invalid aggregate key"}],"meta":{"http_status":400}}`, w.Body.String())
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"},"user_2":{"path":"/bar"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Len(t, m, 2)
+	})
+}
+
+func TestDefaultExecutor_Filters(t *testing.T) {
+	filter := func(key string, r *http.Request) error {
+		if strings.HasPrefix(r.URL.Path, "/admin") {
+			return errors.New("Forbidden path")
+		}
+
+		return nil
+	}
+
+	body := `{"aggregate":{"x1":{"path":"/admin/foo"},"x2":{"path":"/admin/bar"}}}`
+
+	t.Run("empty-ok", func(t *testing.T) {
+		opt := &buffon.DefaultOption{
+			Filters: []buffon.Filter{filter},
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(body))
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Len(t, m, 0)
+	})
+
+	t.Run("empty-bad-request", func(t *testing.T) {
+		opt := &buffon.DefaultOption{
+			Filters: []buffon.Filter{filter},
+			OnEmpty: buffon.EmptyBadRequest,
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.JSONEq(t, `{"errors":[{"message":"No executable aggregate requests"}],"meta":{"http_status":400}}`, w.Body.String())
+	})
+
+	t.Run("empty-reasons", func(t *testing.T) {
+		opt := &buffon.DefaultOption{
+			Filters: []buffon.Filter{filter},
+			OnEmpty: buffon.EmptyReasons,
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.JSONEq(t, `{"errors":[
+			{"message":"No executable aggregate requests"},
+			{"message":"x1: Forbidden path"},
+			{"message":"x2: Forbidden path"}
+		],"meta":{"http_status":422}}`, w.Body.String())
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		opt := &buffon.DefaultOption{
+			Filters:      []buffon.Filter{filter},
+			OnEmpty:      buffon.EmptyBadRequest,
+			FetchLatency: NoopFetchLatency,
+			FetchLogger:  NoopFetchLogger,
+		}
+
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+		assert.Nil(t, err)
+
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/admin/foo"},"x2":{"path":"/bar"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Len(t, m, 2)
+
+		ms, err := exc.Fetch(map[string]*http.Request{"x1": m["x1"]})
+		assert.Len(t, ms, 0)
+
+		err = err.(buffon.ErrorMulti)["x1"]
+		assert.Equal(t, "Forbidden path", err.Error())
+		assert.Equal(t, http.StatusForbidden, err.(buffon.Error).StatusCode)
+		assert.Equal(t, 10011, err.(buffon.Error).ErrCode)
+	})
+}
+
+func TestDefaultExecutor_PathRewrites(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		PathRewrites: []buffon.Rewrite{
+			{Pattern: regexp.MustCompile(`^/v1/users/(\d+)$`), Replacement: "/v2/accounts/$1"},
+			{Pattern: regexp.MustCompile(`^/v1/`), Replacement: "/v3/"},
+		},
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/v1/users/123?foo=bar"},"x2":{"path":"/v1/products"},"x3":{"path":"/v1/users/abc"},"x4":{"path":"/users/123"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+	m, err := exc.Build(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "/v2/accounts/123", m["x1"].URL.Path)
+	assert.Equal(t, "foo=bar", m["x1"].URL.RawQuery)
+	assert.Equal(t, "/v3/products", m["x2"].URL.Path)
+	assert.Equal(t, "/v3/users/abc", m["x3"].URL.Path)
+	assert.Equal(t, "/users/123", m["x4"].URL.Path)
+}
+
+func TestDefaultExecutor_UserAgent(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		UserAgent: "buffon/1.1",
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	data := map[string]string{
+		"":           "buffon/1.1",
+		"aggregator": "aggregator",
+	}
+
+	for original, expected := range data {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		r.Header.Set("User-Agent", "gateway")
+
+		if original != "" {
+			r.Header.Set("User-Agent-Original", original)
+		}
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, m["x1"].Header.Get("User-Agent"))
+	}
+}
+
+func TestDefaultExecutor_OriginalHeaders(t *testing.T) {
+	var logged []string
+
+	opt := &buffon.DefaultOption{
+		OriginalHeaders: []string{"user-agent", "X-Device"},
+		OverrideLogger: func(r *http.Request, name string) {
+			logged = append(logged, name)
+		},
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r.Header.Set("User-Agent", "gateway")
+	r.Header.Set("User-Agent-Original", "aggregator")
+	r.Header.Set("X-Device-Original", "android")
+	r.Header.Set("X-User-Id", "1")
+	r.Header.Set("X-User-Id-Original", "2")
+
+	m, err := exc.Build(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "aggregator", m["x1"].Header.Get("User-Agent"))
+	assert.Equal(t, "android", m["x1"].Header.Get("X-Device"))
+	assert.Equal(t, "1", m["x1"].Header.Get("X-User-Id"))
+	assert.Empty(t, m["x1"].Header.Get("X-User-Id-Original"))
+	assert.Equal(t, []string{"User-Agent"}, logged)
+
+	opt.RejectOverride = true
+
+	exc, err = buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s = strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+	r = httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r.Header.Set("User-Agent", "gateway")
+	r.Header.Set("User-Agent-Original", "aggregator")
+
+	m, err = exc.Build(r)
+	assert.Equal(t, "Original header overrides a forwarded header", err.Error())
+	assert.Nil(t, m)
+
+	s = strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+	r = httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r.Header.Set("User-Agent-Original", "aggregator")
+
+	m, err = exc.Build(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "aggregator", m["x1"].Header.Get("User-Agent"))
+}
+
+type tenantKey struct{}
+
+func TestDefaultExecutor_ContextHeaders(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		ContextHeaders: map[interface{}]string{
+			tenantKey{}:  "X-Tenant-Id",
+			"request-id": "X-Request-Id",
+		},
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo","headers":{"X-Tenant-Id":"other"}}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, 42))
+
+	m, err := exc.Build(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "42", m["x1"].Header.Get("X-Tenant-Id"))
+	assert.Empty(t, m["x1"].Header.Get("X-Request-Id"))
+}
+
+func TestDefaultExecutor_ForwardedFor(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	opt := &buffon.DefaultOption{
+		ForwardedFor:   true,
+		TrustedProxies: []*net.IPNet{trusted},
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	data := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+		realIP     string
+	}{
+		{"202.212.202.212:1234", "", "202.212.202.212", "202.212.202.212"},
+		{"202.212.202.212:1234", "1.1.1.1", "202.212.202.212", "202.212.202.212"},
+		{"10.0.0.2:1234", "1.1.1.1, 202.212.202.212", "202.212.202.212, 10.0.0.2", "202.212.202.212"},
+		{"10.0.0.2:1234", "202.212.202.212, 10.0.0.3", "202.212.202.212, 10.0.0.3, 10.0.0.2", "202.212.202.212"},
+		{"10.0.0.2:1234", "10.0.0.4, 10.0.0.3", "10.0.0.4, 10.0.0.3, 10.0.0.2", "10.0.0.4"},
+		{"10.0.0.2:1234", "unknown, 10.0.0.3", "unknown, 10.0.0.3, 10.0.0.2", "unknown"},
+	}
+
+	for _, x := range data {
+		s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		r.RemoteAddr = x.remoteAddr
+
+		if x.xff != "" {
+			r.Header.Set("X-Forwarded-For", x.xff)
+		}
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Equal(t, x.expected, m["x1"].Header.Get("X-Forwarded-For"))
+		assert.Equal(t, x.realIP, m["x1"].Header.Get("X-Real-Ip"))
+	}
+}
+
+func TestDefaultExecutor_Headers(t *testing.T) {
+	opt := &buffon.DefaultOption{
+		StripHeaders: []string{"Cookie", "X-Internal"},
+	}
+
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{
+		"x1":{"path":"/foo","headers":{"Accept":"text/csv","X-Feature":"on","X-Internal":"1"}},
+		"x2":{"path":"/bar"}
+	}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Cookie", "session=secret")
+
+	m, err := exc.Build(r)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "text/csv", m["x1"].Header.Get("Accept"))
+	assert.Equal(t, "on", m["x1"].Header.Get("X-Feature"))
+	assert.Equal(t, "", m["x1"].Header.Get("X-Internal"))
+	assert.Equal(t, "", m["x1"].Header.Get("Cookie"))
+
+	assert.Equal(t, "application/json", m["x2"].Header.Get("Accept"))
+	assert.Equal(t, "", m["x2"].Header.Get("X-Feature"))
+	assert.Equal(t, "", m["x2"].Header.Get("Cookie"))
+}
+
+func TestDefaultExecutor_PartialMarshal(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://backend.dev/foo", nil)
+
+	b := buffon.FinishData(map[string]interface{}{
+		"x1": map[string]interface{}{"id": 1},
+		"x2": map[string]interface{}{"score": math.NaN()},
+	}, r)
+
+	assert.JSONEq(t, `{
+		"data": {"x1": {"id": 1}},
+		"meta": {"x1": {"http_status": 200}, "x2": {"http_status": 500}},
+		"error": {"x2": [{"code": 10000, "message": "GET /foo: json: unsupported value: NaN"}]}
+	}`, string(b))
+}
+
+func TestDefaultExecutor_Multipart(t *testing.T) {
+	form := func() (*bytes.Buffer, string) {
+		b := &bytes.Buffer{}
+		w := multipart.NewWriter(b)
+		w.WriteField("aggregate", `{"aggregate":{
+			"x1":{"method":"POST","path":"/avatar","body_from_part":"avatar"},
+			"x2":{"method":"POST","path":"/posts","body":{"title":"hello"}},
+			"x3":{"method":"POST","path":"/cover","body_from_part":"cover"}
+		}}`)
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="avatar"; filename="avatar.png"`)
+		h.Set("Content-Type", "image/png")
+
+		p, _ := w.CreatePart(h)
+		p.Write([]byte("PNG!"))
+		w.Close()
+
+		return b, w.FormDataContentType()
+	}
+
+	t.Run("parts", func(t *testing.T) {
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{})
+		assert.Nil(t, err)
+
+		b, contentType := form()
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", b)
+		r.Header.Set("Content-Type", contentType)
+
+		m, err := exc.Build(r)
+		assert.Nil(t, err)
+		assert.Len(t, m, 3)
+
+		body, _ := ioutil.ReadAll(m["x1"].Body)
+		assert.Equal(t, "PNG!", string(body))
+		assert.Equal(t, "image/png", m["x1"].Header.Get("Content-Type"))
+
+		body, _ = ioutil.ReadAll(m["x2"].Body)
+		assert.JSONEq(t, `{"title":"hello"}`, string(body))
+		assert.Equal(t, "application/json", m["x2"].Header.Get("Content-Type"))
+
+		assert.Equal(t, "part", m["x3"].Header.Get("X-Invalid"))
+	})
+
+	t.Run("part-too-large", func(t *testing.T) {
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{MaxPartBytes: 3})
+		assert.Nil(t, err)
+
+		b, contentType := form()
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", b)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Contains(t, w.Body.String(), "Form part is too large")
+	})
+
+	stream := func(doc string, size int) (*bytes.Buffer, string) {
+		b := &bytes.Buffer{}
+		w := multipart.NewWriter(b)
+		w.WriteField("aggregate", doc)
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="stream"; filename="video.mp4"`)
+		h.Set("Content-Type", "video/mp4")
+
+		p, _ := w.CreatePart(h)
+		p.Write(bytes.Repeat([]byte("x"), size))
+		w.Close()
+
+		return b, w.FormDataContentType()
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"data":{"size":%d,"type":%q,"chunked":%t}}`, len(b), r.Header.Get("Content-Type"), len(r.TransferEncoding) != 0)
+		}))
+		defer backend.Close()
+
+		opt := &buffon.DefaultOption{
+			MaxPartBytes: 16,
+			FetchLatency: NoopFetchLatency,
+			FetchLogger:  NoopFetchLogger,
+		}
+
+		exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+		assert.Nil(t, err)
+
+		b, contentType := stream(`{"aggregate":{"x1":{"method":"PUT","path":"/upload","body_from_part":"stream"}}}`, 1<<20)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", b)
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{
+			"data": {"x1": {"size": 1048576, "type": "video/mp4", "chunked": true}},
+			"meta": {"x1": {"http_status": 200}},
+			"error": {}
+		}`, w.Body.String())
+	})
+
+	t.Run("shared-stream", func(t *testing.T) {
+		exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{})
+		assert.Nil(t, err)
+
+		b, contentType := stream(`{"aggregate":{
+			"x1":{"method":"PUT","path":"/a","body_from_part":"stream"},
+			"x2":{"method":"PUT","path":"/b","body_from_part":"stream"}
+		}}`, 4)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", b)
+		r.Header.Set("Content-Type", contentType)
+
+		m, err := exc.Build(r)
+		assert.Equal(t, "Only one aggregate entry can read the stream part", err.Error())
+		assert.Nil(t, m)
+	})
+}
+
+func TestDefaultExecutor_Conditions(t *testing.T) {
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{})
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo","if":"x2.data"},"x2":{"path":"/bar","if":"x1.data"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+	m, err := exc.Build(r)
+	assert.Equal(t, "Conditions must not form a cycle", err.Error())
+	assert.Nil(t, m)
+}
+
+func TestDefaultExecutor_FetchIntoState(t *testing.T) {
+	backend := httptest.NewServer(handler())
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		SLOThreshold: time.Nanosecond,
+		SLOMeta:      true,
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"u1":{"path":"/users/1"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+	mr, err := exc.Build(r)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			var v map[string]interface{}
+			assert.Nil(t, exc.FetchInto(context.Background(), mr, "u1", &v))
+		}()
+	}
+
+	wg.Wait()
+
+	assert.False(t, buffon.SLOBreached(mr["u1"]))
+}
+
+func TestDefaultExecutor_WorkerPool(t *testing.T) {
+	h := &InflightHandler{Handler: handler()}
+
+	backend := httptest.NewServer(h)
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		WorkerPool:     2,
+		MaxConcurrency: 1,
+		FetchLatency:   NoopFetchLatency,
+		FetchLogger:    NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+	defer exc.Close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			s := strings.NewReader(`{"aggregate":{` +
+				`"u1":{"path":"/users/1"},` +
+				`"u2":{"path":"/users/2","if":"u1.data.verified == true"},` +
+				`"u3":{"path":"/users/3","if":"u2.data.verified == true"},` +
+				`"u4":{"path":"/users/4"}}}`)
+			r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+			mr, err := exc.Build(r)
+			assert.Nil(t, err)
+
+			ms, err := exc.Fetch(mr)
+			assert.Len(t, err, 0)
+			assert.Len(t, ms, 4)
+
+			for _, res := range ms {
+				res.Body.Close()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.True(t, h.Max() <= 2, h.Max())
+}
+
+type InflightHandler struct {
+	Handler  http.Handler
+	inflight int32
+	max      int32
+}
+
+func (h *InflightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&h.inflight, 1)
+	defer atomic.AddInt32(&h.inflight, -1)
+
+	for {
+		m := atomic.LoadInt32(&h.max)
+		if n <= m || atomic.CompareAndSwapInt32(&h.max, m, n) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	h.Handler.ServeHTTP(w, r)
+}
+
+func (h *InflightHandler) Max() int {
+	return int(atomic.LoadInt32(&h.max))
+}
+
+func BenchmarkDefaultExecutor_Fetch(b *testing.B) {
+	data := []struct {
+		name string
+		pool int
+	}{
+		{"goroutines", 0},
+		{"pool", 8},
+	}
+
+	for _, x := range data {
+		b.Run(x.name, func(b *testing.B) {
+			h := &InflightHandler{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"data":{},"meta":{"http_status":200}}`))
+			})}
+
+			backend := httptest.NewServer(h)
+			defer backend.Close()
+
+			tr, err := buffon.NewTransport(nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			opt := &buffon.DefaultOption{
+				Transport:    tr,
+				WorkerPool:   x.pool,
+				FetchLatency: NoopFetchLatency,
+				FetchLogger:  NoopFetchLogger,
+			}
+
+			exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer exc.Close()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s := strings.NewReader(`{"aggregate":{"a":{"path":"/a"},"b":{"path":"/b"},"c":{"path":"/c"},"d":{"path":"/d"}}}`)
+					r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+
+					mr, _ := exc.Build(r)
+					ms, _ := exc.Fetch(mr)
+
+					for _, res := range ms {
+						ioutil.ReadAll(res.Body)
+						res.Body.Close()
+					}
+				}
+			})
+
+			b.ReportMetric(float64(h.Max()), "max-inflight")
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package buffon
+
+import (
+	"net/http"
+	"strings"
+)
+
+type deprecation struct {
+	Deprecation string `json:"deprecation,omitempty"`
+	Sunset      string `json:"sunset,omitempty"`
+	Link        string `json:"link,omitempty"`
+}
+
+func parseDeprecation(h http.Header) *deprecation {
+	d := &deprecation{
+		Deprecation: h.Get("Deprecation"),
+		Sunset:      h.Get("Sunset"),
+		Link:        parseLink(h, "deprecation"),
+	}
+
+	if *d == (deprecation{}) {
+		return nil
+	}
+
+	return d
+}
+
+func parseLink(h http.Header, rel string) string {
+	for _, v := range h["Link"] {
+		for _, s := range strings.Split(v, ",") {
+			ps := strings.Split(s, ";")
+			u := strings.TrimSpace(ps[0])
+
+			if !strings.HasPrefix(u, "<") || !strings.HasSuffix(u, ">") {
+				continue
+			}
+
+			for _, p := range ps[1:] {
+				p = strings.TrimSpace(p)
+
+				if !strings.HasPrefix(strings.ToLower(p), "rel=") {
+					continue
+				}
+
+				for _, r := range strings.Fields(strings.Trim(p[4:], `"`)) {
+					if strings.EqualFold(r, rel) {
+						return u[1 : len(u)-1]
+					}
+				}
+			}
+		}
+	}
+
+	return ""
+}
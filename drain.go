@@ -0,0 +1,62 @@
+package buffon
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+var errShuttingDown = Error{Message: "Server is shutting down", StatusCode: http.StatusServiceUnavailable}
+
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+type drain struct {
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+func (d *drain) accepting() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return !d.closing
+}
+
+func (d *drain) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closing {
+		return false
+	}
+
+	d.wg.Add(1)
+	return true
+}
+
+func (d *drain) leave() {
+	d.wg.Done()
+}
+
+func (d *drain) shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+package buffon
+
+import (
+	"bytes"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+type Envelope struct {
+	Data    string
+	Meta    string
+	Message string
+	Errors  string
+}
+
+func (e Envelope) normalize(b []byte) []byte {
+	if e == (Envelope{}) {
+		return b
+	}
+
+	n := json.NewNode(bytes.NewReader(b))
+	if !n.IsValid() {
+		return b
+	}
+
+	keys := []struct {
+		from string
+		to   string
+	}{
+		{e.Data, "data"},
+		{e.Meta, "meta"},
+		{e.Message, "message"},
+		{e.Errors, "errors"},
+	}
+
+	m := make(map[string]interface{})
+
+	for _, k := range keys {
+		if k.from == "" {
+			k.from = k.to
+		}
+
+		var v interface{}
+
+		if err := n.Get(k.from).Unmarshal(&v); err == nil {
+			m[k.to] = v
+		}
+	}
+
+	z, err := json.Marshal(m)
+	if err != nil {
+		return b
+	}
+
+	return z
+}
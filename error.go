@@ -1,6 +1,7 @@
 package buffon
 
 import (
+	"net/http"
 	"strings"
 )
 
@@ -10,7 +11,12 @@ type Error struct {
 	Message    string `json:"message"`
 	StatusCode int    `json:"-"`
 	ErrCode    int    `json:"code"`
+	Detail     string `json:"detail,omitempty"`
 	ErrTimeout bool   `json:"-"`
+	ErrDNS     bool   `json:"-"`
+	ErrRefused bool   `json:"-"`
+	ErrTLS     bool   `json:"-"`
+	request    *http.Request
 }
 
 func (err Error) Error() string {
@@ -0,0 +1,164 @@
+package buffon
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateBuckets   = 10
+	rateUnmatched = "unmatched"
+)
+
+type ErrorRate struct {
+	Requests int64
+	Failures int64
+}
+
+func (e ErrorRate) Rate() float64 {
+	if e.Requests == 0 {
+		return 0
+	}
+
+	return float64(e.Failures) / float64(e.Requests)
+}
+
+type rateBucket struct {
+	epoch    int64
+	requests int64
+	failures int64
+}
+
+type routeRate struct {
+	mu      sync.Mutex
+	latest  int64
+	evicted bool
+	buckets [rateBuckets]rateBucket
+}
+
+type errorRates struct {
+	width  time.Duration
+	swept  int64
+	routes sync.Map
+}
+
+func newErrorRates(window time.Duration) *errorRates {
+	if window <= 0 {
+		return nil
+	}
+
+	width := window / rateBuckets
+	if width <= 0 {
+		width = 1
+	}
+
+	return &errorRates{width: width}
+}
+
+func (e *errorRates) Record(route string, failed bool, now time.Time) {
+	if e == nil {
+		return
+	}
+
+	epoch := now.UnixNano() / int64(e.width)
+
+	e.sweep(epoch)
+
+	for !e.record(route, failed, epoch) {
+	}
+}
+
+func (e *errorRates) record(route string, failed bool, epoch int64) bool {
+	v, ok := e.routes.Load(route)
+	if !ok {
+		v, _ = e.routes.LoadOrStore(route, &routeRate{})
+	}
+
+	z := v.(*routeRate)
+	z.mu.Lock()
+
+	if z.evicted {
+		z.mu.Unlock()
+		return false
+	}
+
+	if epoch > z.latest {
+		z.latest = epoch
+	}
+
+	b := &z.buckets[epoch%rateBuckets]
+
+	if b.epoch > epoch {
+		z.mu.Unlock()
+		return true
+	}
+
+	if b.epoch != epoch {
+		*b = rateBucket{epoch: epoch}
+	}
+
+	b.requests++
+
+	if failed {
+		b.failures++
+	}
+
+	z.mu.Unlock()
+	return true
+}
+
+func (e *errorRates) sweep(epoch int64) {
+	last := atomic.LoadInt64(&e.swept)
+
+	if epoch-last < rateBuckets || !atomic.CompareAndSwapInt64(&e.swept, last, epoch) {
+		return
+	}
+
+	e.routes.Range(func(k, v interface{}) bool {
+		z := v.(*routeRate)
+		z.mu.Lock()
+
+		if epoch-z.latest >= rateBuckets {
+			z.evicted = true
+			e.routes.Delete(k)
+		}
+
+		z.mu.Unlock()
+		return true
+	})
+}
+
+func (e *errorRates) Snapshot(now time.Time) map[string]ErrorRate {
+	m := make(map[string]ErrorRate)
+
+	if e == nil {
+		return m
+	}
+
+	epoch := now.UnixNano() / int64(e.width)
+
+	e.routes.Range(func(k, v interface{}) bool {
+		var rate ErrorRate
+
+		z := v.(*routeRate)
+		z.mu.Lock()
+
+		for _, b := range z.buckets {
+			if epoch-b.epoch < rateBuckets {
+				rate.Requests += b.requests
+				rate.Failures += b.failures
+			}
+		}
+
+		z.mu.Unlock()
+
+		if rate.Requests != 0 {
+			m[k.(string)] = rate
+		}
+
+		return true
+	})
+
+	return m
+}
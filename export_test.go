@@ -0,0 +1,61 @@
+package buffon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+func FinishData(data map[string]interface{}, r *http.Request) []byte {
+	n := newResponse()
+	ms := make(map[string]*http.Response)
+
+	for k, v := range data {
+		n.Data[k] = v
+		n.addStatus(k, http.StatusOK)
+		ms[k] = &http.Response{Request: r}
+	}
+
+	x := &defaultFinisher{}
+	x.isolate(n, ms)
+
+	b, _ := json.Marshal(n)
+	return b
+}
+
+func ErrorRatesAt(window time.Duration, records map[time.Time]bool, now time.Time) map[string]ErrorRate {
+	e := newErrorRates(window)
+
+	for t, failed := range records {
+		e.Record("GET /users/:id", failed, t)
+	}
+
+	return e.Snapshot(now)
+}
+
+type RateRecord struct {
+	Route string
+	At    time.Time
+}
+
+func ErrorRoutesAt(window time.Duration, records []RateRecord) []string {
+	e := newErrorRates(window)
+
+	for _, x := range records {
+		e.Record(x.Route, false, x.At)
+	}
+
+	var ss []string
+
+	e.routes.Range(func(k, v interface{}) bool {
+		ss = append(ss, k.(string))
+		return true
+	})
+
+	return ss
+}
+
+func SLOBreached(r *http.Request) bool {
+	return subRequestOf(r).sloBreach
+}
@@ -0,0 +1,72 @@
+package buffon
+
+import (
+	"strings"
+)
+
+func selectFields(v interface{}, fields []string) interface{} {
+	switch z := v.(type) {
+	case []interface{}:
+		vs := make([]interface{}, len(z))
+
+		for i := range z {
+			vs[i] = selectFields(z[i], fields)
+		}
+
+		return vs
+	case map[string]interface{}:
+		m := make(map[string]interface{})
+
+		for _, s := range fields {
+			selectField(m, z, strings.Split(s, "."))
+		}
+
+		return m
+	}
+
+	return v
+}
+
+func selectField(dst, src map[string]interface{}, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+
+	switch z := v.(type) {
+	case map[string]interface{}:
+		m, ok := dst[path[0]].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			dst[path[0]] = m
+		}
+
+		selectField(m, z, path[1:])
+	case []interface{}:
+		vs, ok := dst[path[0]].([]interface{})
+		if !ok {
+			vs = make([]interface{}, len(z))
+			dst[path[0]] = vs
+		}
+
+		for i := range z {
+			zm, ok := z[i].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			m, ok := vs[i].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				vs[i] = m
+			}
+
+			selectField(m, zm, path[1:])
+		}
+	}
+}
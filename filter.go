@@ -0,0 +1,53 @@
+package buffon
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+var errNoExecutable = errors.New("No executable aggregate requests")
+
+type Filter func(key string, r *http.Request) error
+
+type EmptyMode int
+
+const (
+	EmptyOK EmptyMode = iota
+	EmptyBadRequest
+	EmptyReasons
+)
+
+type filteredError struct {
+	err error
+}
+
+func (e filteredError) Error() string {
+	return e.err.Error()
+}
+
+type filterError struct {
+	reasons ErrorMulti
+}
+
+func (e filterError) Error() string {
+	return errNoExecutable.Error()
+}
+
+func (e filterError) Messages() []string {
+	ks := make([]string, 0, len(e.reasons))
+
+	for k := range e.reasons {
+		ks = append(ks, k)
+	}
+
+	sort.Strings(ks)
+
+	ss := []string{e.Error()}
+
+	for _, k := range ks {
+		ss = append(ss, k+": "+e.reasons[k].Error())
+	}
+
+	return ss
+}
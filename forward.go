@@ -0,0 +1,53 @@
+package buffon
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+func forwardedFor(r *http.Request, trusted []*net.IPNet) (string, string) {
+	var chain []string
+
+	for _, v := range r.Header["X-Forwarded-For"] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				chain = append(chain, s)
+			}
+		}
+	}
+
+	chain = append(chain, remoteIP(r))
+
+	i := len(chain) - 1
+
+	for i > 0 && isTrusted(chain[i], trusted) {
+		i--
+	}
+
+	return strings.Join(chain[i:], ", "), chain[i]
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func isTrusted(s string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -6,4 +6,5 @@ require (
 	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40
 	github.com/bukalapak/ottoman v1.4.0
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/net v0.17.0
 )
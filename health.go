@@ -0,0 +1,55 @@
+package buffon
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errNotReady = errors.New("Backend is unavailable")
+
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type HealthCheck struct {
+	P        Pinger
+	Interval time.Duration
+	failed   int32
+}
+
+func NewHealthCheck(p Pinger, interval time.Duration) *HealthCheck {
+	return &HealthCheck{P: p, Interval: interval}
+}
+
+func (h *HealthCheck) Run(ctx context.Context) {
+	t := time.NewTicker(h.Interval)
+	defer t.Stop()
+
+	for {
+		h.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (h *HealthCheck) Check(ctx context.Context) error {
+	err := h.P.Ping(ctx)
+
+	if err != nil {
+		atomic.StoreInt32(&h.failed, 1)
+	} else {
+		atomic.StoreInt32(&h.failed, 0)
+	}
+
+	return err
+}
+
+func (h *HealthCheck) Healthy() bool {
+	return atomic.LoadInt32(&h.failed) == 0
+}
@@ -0,0 +1,72 @@
+package buffon_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bukalapak/buffon"
+	"github.com/stretchr/testify/assert"
+)
+
+type Pinger struct {
+	err error
+}
+
+func (p *Pinger) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func TestHealthCheck(t *testing.T) {
+	p := &Pinger{}
+	h := buffon.NewHealthCheck(p, time.Second)
+	assert.True(t, h.Healthy())
+
+	p.err = errors.New("Connection failure")
+	assert.NotNil(t, h.Check(context.Background()))
+	assert.False(t, h.Healthy())
+
+	p.err = nil
+	assert.Nil(t, h.Check(context.Background()))
+	assert.True(t, h.Healthy())
+}
+
+func TestHealthCheck_Run(t *testing.T) {
+	p := &Pinger{err: errors.New("Connection failure")}
+	h := buffon.NewHealthCheck(p, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.False(t, h.Healthy())
+}
+
+func TestAggregator_Ready(t *testing.T) {
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{})
+	assert.Nil(t, err)
+
+	agg := buffon.NewAggregator(exc)
+	agg.Ready = func() bool { return false }
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/foo"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	agg.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"errors":[{"message":"Backend is unavailable"}],"meta":{"http_status":503}}`, w.Body.String())
+}
@@ -0,0 +1,127 @@
+package buffon
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+const defaultLatencySamples = 1024
+
+type LatencySnapshot struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"-"`
+	P95   time.Duration `json:"-"`
+	P99   time.Duration `json:"-"`
+	P50MS float64       `json:"p50_ms"`
+	P95MS float64       `json:"p95_ms"`
+	P99MS float64       `json:"p99_ms"`
+}
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	count   int
+}
+
+type LatencyRecorder struct {
+	Samples int
+	mu      sync.Mutex
+	routes  map[string]*latencyWindow
+}
+
+func NewLatencyRecorder(samples int) *LatencyRecorder {
+	return &LatencyRecorder{Samples: samples}
+}
+
+func (l *LatencyRecorder) Record(route string, n time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.routes == nil {
+		l.routes = make(map[string]*latencyWindow)
+	}
+
+	w, ok := l.routes[route]
+	if !ok {
+		size := l.Samples
+		if size <= 0 {
+			size = defaultLatencySamples
+		}
+
+		w = &latencyWindow{samples: make([]time.Duration, 0, size)}
+		l.routes[route] = w
+	}
+
+	if len(w.samples) < cap(w.samples) {
+		w.samples = append(w.samples, n)
+	} else {
+		w.samples[w.next] = n
+		w.next = (w.next + 1) % len(w.samples)
+	}
+
+	w.count++
+}
+
+func (l *LatencyRecorder) FetchLatency(n time.Duration, method, routePattern string, statusCode int) {
+	l.Record(method+" "+routePattern, n)
+}
+
+func (l *LatencyRecorder) Snapshot() map[string]LatencySnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m := make(map[string]LatencySnapshot, len(l.routes))
+
+	for route, w := range l.routes {
+		ds := make([]time.Duration, len(w.samples))
+		copy(ds, w.samples)
+		sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+
+		z := LatencySnapshot{
+			Count: w.count,
+			P50:   percentile(ds, 50),
+			P95:   percentile(ds, 95),
+			P99:   percentile(ds, 99),
+		}
+
+		z.P50MS = milliseconds(z.P50)
+		z.P95MS = milliseconds(z.P95)
+		z.P99MS = milliseconds(z.P99)
+
+		m[route] = z
+	}
+
+	return m
+}
+
+func (l *LatencyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(l.Snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+
+	i := (len(ds)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return ds[i]
+}
+
+func milliseconds(n time.Duration) float64 {
+	return float64(n) / float64(time.Millisecond)
+}
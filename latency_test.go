@@ -0,0 +1,54 @@
+package buffon_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bukalapak/buffon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyRecorder(t *testing.T) {
+	l := buffon.NewLatencyRecorder(0)
+
+	var wg sync.WaitGroup
+
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			l.FetchLatency(time.Duration(i)*time.Millisecond, "GET", "/users/{id}", http.StatusOK)
+		}(i)
+	}
+
+	wg.Wait()
+
+	z := l.Snapshot()["GET /users/{id}"]
+	assert.Equal(t, 100, z.Count)
+	assert.Equal(t, 50*time.Millisecond, z.P50)
+	assert.Equal(t, 95*time.Millisecond, z.P95)
+	assert.Equal(t, 99*time.Millisecond, z.P99)
+
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/latency", nil))
+
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"GET /users/{id}":{"count":100,"p50_ms":50,"p95_ms":95,"p99_ms":99}}`, w.Body.String())
+}
+
+func TestLatencyRecorder_Samples(t *testing.T) {
+	l := buffon.NewLatencyRecorder(10)
+
+	for i := 1; i <= 20; i++ {
+		l.Record("/foo", time.Duration(i)*time.Millisecond)
+	}
+
+	z := l.Snapshot()["/foo"]
+	assert.Equal(t, 20, z.Count)
+	assert.Equal(t, 15*time.Millisecond, z.P50)
+	assert.Equal(t, 20*time.Millisecond, z.P99)
+}
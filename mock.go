@@ -0,0 +1,50 @@
+package buffon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type Mock struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+func mockResponse(mocks map[string]Mock, r *http.Request) (*http.Response, bool) {
+	m, ok := mocks[r.Method+" "+r.URL.Path]
+	if !ok {
+		if m, ok = mocks[r.URL.Path]; !ok {
+			return nil, false
+		}
+	}
+
+	code := m.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+
+	header := make(http.Header)
+
+	for k, v := range m.Header {
+		header[k] = append([]string(nil), v...)
+	}
+
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Status:        fmt.Sprintf("%03d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Request:       r,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(m.Body)),
+		ContentLength: int64(len(m.Body)),
+	}, true
+}
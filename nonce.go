@@ -0,0 +1,83 @@
+package buffon
+
+import (
+	"container/heap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errMissingNonce = Error{Message: "Missing request nonce", StatusCode: http.StatusBadRequest}
+	errReplayNonce  = Error{Message: "Request nonce has already been used", StatusCode: http.StatusConflict}
+)
+
+type NonceStore interface {
+	Seen(nonce string, window time.Duration) bool
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(v interface{}) { *h = append(*h, v.(nonceEntry)) }
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	v := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return v
+}
+
+type memoryNonceStore struct {
+	mu      *sync.Mutex
+	seen    map[string]bool
+	expires nonceHeap
+}
+
+func NewMemoryNonceStore() NonceStore {
+	return &memoryNonceStore{
+		mu:   &sync.Mutex{},
+		seen: make(map[string]bool),
+	}
+}
+
+func (s *memoryNonceStore) Seen(nonce string, window time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for len(s.expires) != 0 && now.After(s.expires[0].expires) {
+		delete(s.seen, heap.Pop(&s.expires).(nonceEntry).nonce)
+	}
+
+	if s.seen[nonce] {
+		return true
+	}
+
+	s.seen[nonce] = true
+	heap.Push(&s.expires, nonceEntry{nonce: nonce, expires: now.Add(window)})
+
+	return false
+}
+
+func checkNonce(s NonceStore, window time.Duration, r *http.Request) error {
+	nonce := r.Header.Get("X-Nonce")
+	if nonce == "" {
+		return errMissingNonce
+	}
+
+	if s.Seen(nonce, window) {
+		return errReplayNonce
+	}
+
+	return nil
+}
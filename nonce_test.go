@@ -0,0 +1,64 @@
+package buffon_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bukalapak/buffon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryNonceStore(t *testing.T) {
+	s := buffon.NewMemoryNonceStore()
+
+	assert.False(t, s.Seen("n1", time.Minute))
+	assert.True(t, s.Seen("n1", time.Minute))
+	assert.False(t, s.Seen("n2", time.Millisecond))
+
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, s.Seen("n2", time.Millisecond))
+	assert.True(t, s.Seen("n1", time.Minute))
+}
+
+func TestAggregator_Nonce(t *testing.T) {
+	exc, err := buffon.NewDefaultExecutor("http://backend.dev", &buffon.DefaultOption{
+		DryRun:       true,
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	})
+	assert.Nil(t, err)
+
+	agg := buffon.NewAggregator(exc)
+	agg.Nonce = buffon.NewMemoryNonceStore()
+	agg.NonceWindow = time.Minute
+
+	data := []struct {
+		nonce string
+		code  int
+		body  string
+	}{
+		{"", http.StatusBadRequest, "Missing request nonce"},
+		{"abc", http.StatusOK, `"data"`},
+		{"abc", http.StatusConflict, "Request nonce has already been used"},
+		{"def", http.StatusOK, `"data"`},
+	}
+
+	for _, x := range data {
+		s := strings.NewReader(`{"aggregate":{"x1":{"method":"POST","path":"/posts"}}}`)
+		r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+		w := httptest.NewRecorder()
+
+		if x.nonce != "" {
+			r.Header.Set("X-Nonce", x.nonce)
+		}
+
+		agg.ServeHTTP(w, r)
+
+		assert.Equal(t, x.code, w.Code)
+		assert.Contains(t, w.Body.String(), x.body)
+	}
+}
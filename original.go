@@ -0,0 +1,46 @@
+package buffon
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const originalSuffix = "-Original"
+
+func originalName(k string) string {
+	return strings.Replace(k, originalSuffix, "", 1)
+}
+
+func originalAllowed(allowed []string, s string) bool {
+	if allowed == nil {
+		return true
+	}
+
+	for _, v := range allowed {
+		if http.CanonicalHeaderKey(v) == http.CanonicalHeaderKey(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func originalOverrides(r *http.Request, allowed []string) []string {
+	var ss []string
+
+	for k := range r.Header {
+		if !strings.HasSuffix(k, originalSuffix) {
+			continue
+		}
+
+		s := originalName(k)
+
+		if _, ok := r.Header[s]; ok && originalAllowed(allowed, s) {
+			ss = append(ss, s)
+		}
+	}
+
+	sort.Strings(ss)
+	return ss
+}
@@ -0,0 +1,83 @@
+package buffon
+
+import (
+	"sync"
+)
+
+type workerPool struct {
+	mu     *sync.Mutex
+	cond   *sync.Cond
+	tasks  []func()
+	closed bool
+}
+
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		return nil
+	}
+
+	mu := &sync.Mutex{}
+
+	p := &workerPool{
+		mu:   mu,
+		cond: sync.NewCond(mu),
+	}
+
+	for i := 0; i < n; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+
+		for len(p.tasks) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+
+		if len(p.tasks) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		f := p.tasks[0]
+		p.tasks[0] = nil
+		p.tasks = p.tasks[1:]
+		p.mu.Unlock()
+
+		f()
+	}
+}
+
+func (p *workerPool) Go(f func()) {
+	if p == nil {
+		go f()
+		return
+	}
+
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		go f()
+		return
+	}
+
+	p.tasks = append(p.tasks, f)
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+func (p *workerPool) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
@@ -0,0 +1,111 @@
+package buffon
+
+import (
+	"container/heap"
+	"net/http"
+	"sync"
+)
+
+type fetchQueue struct {
+	mu      *sync.Mutex
+	limit   int
+	free    int
+	waiters waiterHeap
+}
+
+type waiter struct {
+	priority int
+	index    int
+	ready    func()
+}
+
+func newFetchQueue(n int) *fetchQueue {
+	if n <= 0 {
+		return nil
+	}
+
+	return &fetchQueue{mu: &sync.Mutex{}, limit: n}
+}
+
+func (q *fetchQueue) Acquire(r *http.Request, ready func()) {
+	if q == nil {
+		ready()
+		return
+	}
+
+	w := &waiter{
+		priority: aggregatePriority(r),
+		index:    aggregateIndex(r),
+		ready:    ready,
+	}
+
+	q.mu.Lock()
+	heap.Push(&q.waiters, w)
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+func (q *fetchQueue) Start() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.free = q.limit
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+func (q *fetchQueue) Release() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.free++
+	q.dispatch()
+	q.mu.Unlock()
+}
+
+func (q *fetchQueue) dispatch() {
+	for q.free > 0 && q.waiters.Len() > 0 {
+		w := heap.Pop(&q.waiters).(*waiter)
+		q.free--
+		w.ready()
+	}
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int {
+	return len(h)
+}
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+
+	return h[i].index < h[j].index
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	*h = append(*h, x.(*waiter))
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	*h = old[:n-1]
+
+	return w
+}
+
+func aggregatePriority(r *http.Request) int {
+	return subRequestOf(r).priority
+}
@@ -0,0 +1,68 @@
+package buffon
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type retryBudget struct {
+	mu    *sync.Mutex
+	limit int
+	used  int
+}
+
+func newRetryBudget(n int) *retryBudget {
+	return &retryBudget{mu: &sync.Mutex{}, limit: n}
+}
+
+func (b *retryBudget) Take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit != 0 && b.used >= b.limit {
+		return false
+	}
+
+	b.used++
+	return true
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+func retryAfter(res *http.Response) (int, bool) {
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return 0, false
+	}
+
+	s := res.Header.Get("Retry-After")
+	if s == "" {
+		return 0, false
+	}
+
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return n, true
+	}
+
+	t, err := http.ParseTime(s)
+	if err != nil {
+		return 0, false
+	}
+
+	n := int((time.Until(t) + time.Second - 1) / time.Second)
+	if n < 0 {
+		n = 0
+	}
+
+	return n, true
+}
@@ -0,0 +1,20 @@
+package buffon
+
+import (
+	"regexp"
+)
+
+type Rewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func rewritePath(rs []Rewrite, s string) string {
+	for _, r := range rs {
+		if r.Pattern.MatchString(s) {
+			return r.Pattern.ReplaceAllString(s, r.Replacement)
+		}
+	}
+
+	return s
+}
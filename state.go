@@ -0,0 +1,72 @@
+package buffon
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type subRequestKey struct{}
+
+type subRequest struct {
+	dedupe      string
+	cond        string
+	skipped     bool
+	expect      []int
+	passthrough bool
+	mergeInto   string
+	as          string
+	sloBreach   bool
+	index       int
+	fields      []string
+	merge       bool
+	priority    int
+	cacheKey    string
+	warnings    []string
+	ttfb        time.Duration
+	connect     time.Duration
+	filtered    error
+	keyHeaders  []string
+	service     string
+}
+
+func withSubRequest(r *http.Request, s *subRequest) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), subRequestKey{}, s))
+}
+
+func subRequestOf(r *http.Request) *subRequest {
+	if s, ok := r.Context().Value(subRequestKey{}).(*subRequest); ok {
+		return s
+	}
+
+	return &subRequest{}
+}
+
+func (s *subRequest) clone() *subRequest {
+	z := *s
+	z.skipped = false
+	z.sloBreach = false
+	z.warnings = append([]string(nil), s.warnings...)
+
+	return &z
+}
+
+func internalHeader(k string) bool {
+	switch http.CanonicalHeaderKey(k) {
+	case "X-Invalid", "X-Timeout", "X-Ttfb-Timeout", "X-Connect-Timeout":
+		return true
+	case "X-Aggregate-Id":
+		return false
+	}
+
+	return strings.HasPrefix(http.CanonicalHeaderKey(k), "X-Aggregate-")
+}
+
+func stripInternal(h http.Header) {
+	for k := range h {
+		if internalHeader(k) {
+			h.Del(k)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package buffon
+
+import (
+	"net/http"
+)
+
+type StatusPolicy func(total, failed, timeout int) int
+
+func StatusAlwaysOK(total, failed, timeout int) int {
+	return http.StatusOK
+}
+
+func StatusAllFailed(total, failed, timeout int) int {
+	if total == 0 || failed < total {
+		return http.StatusOK
+	}
+
+	if timeout == total {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+func StatusMultiStatus(total, failed, timeout int) int {
+	if failed == 0 {
+		return http.StatusOK
+	}
+
+	if failed < total {
+		return http.StatusMultiStatus
+	}
+
+	return StatusAllFailed(total, failed, timeout)
+}
@@ -0,0 +1,27 @@
+package buffon_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bukalapak/buffon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusAlwaysOK(t *testing.T) {
+	assert.Equal(t, http.StatusOK, buffon.StatusAlwaysOK(2, 2, 2))
+}
+
+func TestStatusAllFailed(t *testing.T) {
+	assert.Equal(t, http.StatusOK, buffon.StatusAllFailed(0, 0, 0))
+	assert.Equal(t, http.StatusOK, buffon.StatusAllFailed(2, 1, 1))
+	assert.Equal(t, http.StatusBadGateway, buffon.StatusAllFailed(2, 2, 1))
+	assert.Equal(t, http.StatusGatewayTimeout, buffon.StatusAllFailed(2, 2, 2))
+}
+
+func TestStatusMultiStatus(t *testing.T) {
+	assert.Equal(t, http.StatusOK, buffon.StatusMultiStatus(2, 0, 0))
+	assert.Equal(t, http.StatusMultiStatus, buffon.StatusMultiStatus(2, 1, 0))
+	assert.Equal(t, http.StatusBadGateway, buffon.StatusMultiStatus(2, 2, 0))
+	assert.Equal(t, http.StatusGatewayTimeout, buffon.StatusMultiStatus(2, 2, 2))
+}
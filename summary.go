@@ -0,0 +1,53 @@
+package buffon
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+type aggregateStartKey struct{}
+
+type summary struct {
+	Total      int      `json:"total"`
+	Succeeded  []string `json:"succeeded"`
+	Failed     []string `json:"failed"`
+	Skipped    []string `json:"skipped"`
+	DurationMS int64    `json:"duration_ms"`
+}
+
+func newSummary(n *response, ms map[string]*http.Response, me ErrorMulti, rq map[string]*http.Request, discarded bool) *summary {
+	z := &summary{
+		Total:     len(ms) + len(me),
+		Succeeded: []string{},
+		Failed:    []string{},
+		Skipped:   []string{},
+	}
+
+	for k := range me {
+		z.Failed = append(z.Failed, k)
+	}
+
+	for k, res := range ms {
+		switch {
+		case len(n.Error[k]) != 0 || discarded:
+			z.Failed = append(z.Failed, k)
+		case aggregateSkipped(res.Request):
+			z.Skipped = append(z.Skipped, k)
+		default:
+			z.Succeeded = append(z.Succeeded, k)
+		}
+	}
+
+	sort.Strings(z.Succeeded)
+	sort.Strings(z.Failed)
+	sort.Strings(z.Skipped)
+
+	if r := anyRequest(rq); r != nil {
+		if t, ok := r.Context().Value(aggregateStartKey{}).(time.Time); ok {
+			z.DurationMS = int64(time.Since(t) / time.Millisecond)
+		}
+	}
+
+	return z
+}
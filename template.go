@@ -0,0 +1,98 @@
+package buffon
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var templatePattern = regexp.MustCompile(`\{\{\s*request\.(query|header)\.([^{}\s]+)\s*\}\}`)
+
+func expandPayload(r *http.Request, p payload) payload {
+	p.Path = expandPath(r, p.Path)
+	p.Body = expandValue(r, p.Body)
+
+	if len(p.Headers) != 0 {
+		hs := make(map[string]string, len(p.Headers))
+
+		for k, v := range p.Headers {
+			hs[k] = expandTemplate(r, v, nil)
+		}
+
+		p.Headers = hs
+	}
+
+	if len(p.Query) != 0 {
+		q := make(url.Values, len(p.Query))
+
+		for k, vs := range p.Query {
+			for _, v := range vs {
+				q.Add(k, expandTemplate(r, v, nil))
+			}
+		}
+
+		p.Query = q
+	}
+
+	return p
+}
+
+func expandPath(r *http.Request, s string) string {
+	i := strings.Index(s, "?")
+	if i < 0 {
+		return expandTemplate(r, s, url.PathEscape)
+	}
+
+	return expandTemplate(r, s[:i], url.PathEscape) + "?" + expandTemplate(r, s[i+1:], url.QueryEscape)
+}
+
+func expandValue(r *http.Request, v interface{}) interface{} {
+	switch z := v.(type) {
+	case string:
+		return expandTemplate(r, z, nil)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(z))
+
+		for k, v := range z {
+			m[k] = expandValue(r, v)
+		}
+
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(z))
+
+		for i, v := range z {
+			a[i] = expandValue(r, v)
+		}
+
+		return a
+	}
+
+	return v
+}
+
+func expandTemplate(r *http.Request, s string, escape func(string) string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+
+	return templatePattern.ReplaceAllStringFunc(s, func(m string) string {
+		z := templatePattern.FindStringSubmatch(m)
+
+		var v string
+
+		switch z[1] {
+		case "query":
+			v = r.URL.Query().Get(z[2])
+		case "header":
+			v = r.Header.Get(z[2])
+		}
+
+		if escape != nil {
+			v = escape(v)
+		}
+
+		return v
+	})
+}
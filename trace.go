@@ -0,0 +1,17 @@
+package buffon
+
+import (
+	"net/http"
+)
+
+type Tracer interface {
+	Start(r *http.Request) (*http.Request, Span)
+}
+
+type Span interface {
+	End(method, routePattern string, statusCode int, err error)
+}
+
+type noopSpan struct{}
+
+func (s noopSpan) End(method, routePattern string, statusCode int, err error) {}
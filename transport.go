@@ -0,0 +1,75 @@
+package buffon
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+type TransportOption struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	HTTP2               bool
+}
+
+func NewTransport(opt *TransportOption) (*http.Transport, error) {
+	if opt == nil {
+		opt = &TransportOption{}
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          512,
+		MaxIdleConnsPerHost:   64,
+		MaxConnsPerHost:       opt.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if opt.MaxIdleConns != 0 {
+		t.MaxIdleConns = opt.MaxIdleConns
+	}
+
+	if opt.MaxIdleConnsPerHost != 0 {
+		t.MaxIdleConnsPerHost = opt.MaxIdleConnsPerHost
+	}
+
+	if opt.IdleConnTimeout != 0 {
+		t.IdleConnTimeout = opt.IdleConnTimeout
+	}
+
+	if opt.HTTP2 {
+		if err := http2.ConfigureTransport(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func NewH2CTransport() *http2.Transport {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+}
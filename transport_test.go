@@ -0,0 +1,147 @@
+package buffon_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bukalapak/buffon"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestNewTransport(t *testing.T) {
+	tr, err := buffon.NewTransport(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 512, tr.MaxIdleConns)
+	assert.Equal(t, 64, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 0, tr.MaxConnsPerHost)
+	assert.Equal(t, 90*time.Second, tr.IdleConnTimeout)
+
+	tr, err = buffon.NewTransport(&buffon.TransportOption{
+		MaxIdleConns:        1000,
+		MaxIdleConnsPerHost: 200,
+		MaxConnsPerHost:     300,
+		IdleConnTimeout:     time.Minute,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1000, tr.MaxIdleConns)
+	assert.Equal(t, 200, tr.MaxIdleConnsPerHost)
+	assert.Equal(t, 300, tr.MaxConnsPerHost)
+	assert.Equal(t, time.Minute, tr.IdleConnTimeout)
+
+	backend := httptest.NewServer(handler())
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		Transport:    tr,
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"u1":{"path":"/users/1"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	agg := buffon.NewAggregator(exc)
+	agg.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestNewH2CTransport(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+			case <-time.After(time.Second):
+			}
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":{"proto":%q}}`, r.Proto)
+	})
+
+	backend := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	defer backend.Close()
+
+	opt := &buffon.DefaultOption{
+		Transport:    buffon.NewH2CTransport(),
+		Timeout:      50 * time.Millisecond,
+		MaxTimeout:   time.Second,
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/proto"},"x2":{"path":"/slow"},"x3":{"path":"/slow","timeout":500,"ttfb_timeout":50}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"data": {"x1": {"proto": "HTTP/2.0"}},
+		"meta": {"x1": {"http_status": 200}, "x2": {"http_status": 504}, "x3": {"http_status": 504}},
+		"error": {
+			"x2": [{"code": 10000, "message": "GET /slow: timeout of 50ms exceeded"}],
+			"x3": [{"code": 10000, "message": "GET /slow: time to first byte of 50ms exceeded"}]
+		}
+	}`, w.Body.String())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("backend stream was not canceled")
+		}
+	}
+}
+
+func TestNewTransport_HTTP2(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"data":{"proto":%q}}`, r.Proto)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	tr, err := buffon.NewTransport(&buffon.TransportOption{HTTP2: true})
+	assert.Nil(t, err)
+	tr.TLSClientConfig.RootCAs = backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	opt := &buffon.DefaultOption{
+		Transport:    tr,
+		FetchLatency: NoopFetchLatency,
+		FetchLogger:  NoopFetchLogger,
+	}
+
+	exc, err := buffon.NewDefaultExecutor(backend.URL, opt)
+	assert.Nil(t, err)
+
+	s := strings.NewReader(`{"aggregate":{"x1":{"path":"/proto"}}}`)
+	r := httptest.NewRequest("POST", "http://example.com/aggregate", s)
+	w := httptest.NewRecorder()
+
+	buffon.NewAggregator(exc).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{"x1":{"proto":"HTTP/2.0"}},"meta":{"x1":{"http_status":200}},"error":{}}`, w.Body.String())
+}
@@ -0,0 +1,117 @@
+package buffon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+const streamPart = "stream"
+
+var (
+	errUnknownPart  = errors.New("Unknown form part")
+	errPartTooLarge = Error{Message: "Form part is too large", StatusCode: http.StatusRequestEntityTooLarge}
+	errSharedStream = errors.New("Only one aggregate entry can read the stream part")
+)
+
+type formPart struct {
+	ContentType string
+	Content     []byte
+	Stream      io.Reader
+}
+
+func isMultipart(r *http.Request) bool {
+	s, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && s == "multipart/form-data"
+}
+
+func readMultipart(r *http.Request, limit int64) (io.Reader, map[string]formPart, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, errMissedQuery
+	}
+
+	var doc []byte
+
+	parts := make(map[string]formPart)
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, readError(err)
+		}
+
+		if p.FormName() == "aggregate" {
+			if doc, err = readPart(p, 0); err != nil {
+				return nil, nil, err
+			}
+
+			continue
+		}
+
+		contentType := p.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		if p.FormName() == streamPart {
+			parts[streamPart] = formPart{ContentType: contentType, Stream: p}
+			break
+		}
+
+		b, err := readPart(p, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		parts[p.FormName()] = formPart{ContentType: contentType, Content: b}
+	}
+
+	return bytes.NewReader(doc), parts, nil
+}
+
+func readPart(r io.Reader, limit int64) ([]byte, error) {
+	if limit != 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, readError(err)
+	}
+
+	if limit != 0 && int64(len(b)) > limit {
+		return nil, errPartTooLarge
+	}
+
+	return b, nil
+}
+
+func sharesStream(a aggregate) bool {
+	var n int
+
+	for _, p := range a {
+		if p.BodyFromPart == streamPart {
+			n++
+		}
+	}
+
+	return n > 1
+}
+
+func readError(err error) error {
+	var mb *http.MaxBytesError
+
+	if errors.As(err, &mb) {
+		return errRequestTooLarge
+	}
+
+	return errMissedQuery
+}
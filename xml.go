@@ -0,0 +1,144 @@
+package buffon
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bukalapak/ottoman/encoding/json"
+)
+
+var errEncodeXML = errors.New("Unable to encode XML response")
+
+func prefersXML(accept string) bool {
+	for _, s := range strings.Split(accept, ",") {
+		t, _, err := mime.ParseMediaType(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+
+		switch t {
+		case "application/json":
+			return false
+		case "application/xml":
+			return true
+		}
+	}
+
+	return false
+}
+
+func marshalXML(name string, b []byte) ([]byte, error) {
+	var z interface{}
+
+	if err := json.Unmarshal(b, &z); err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(buf)
+
+	if err := encodeXML(enc, name, z); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeXML(enc *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	if !isXMLName(name) {
+		start.Name.Local = "item"
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}}
+	}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch z := v.(type) {
+	case map[string]interface{}:
+		ks := make([]string, 0, len(z))
+
+		for k := range z {
+			ks = append(ks, k)
+		}
+
+		sort.Strings(ks)
+
+		for _, k := range ks {
+			if err := encodeXML(enc, k, z[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, s := range z {
+			if err := encodeXML(enc, "item", s); err != nil {
+				return err
+			}
+		}
+	case nil:
+	case float64:
+		if err := enc.EncodeToken(xml.CharData(strconv.FormatFloat(z, 'f', -1, 64))); err != nil {
+			return err
+		}
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(z))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+func isXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i, c := range s {
+		if !isXMLNameStart(c) && (i == 0 || !isXMLNameChar(c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isXMLNameStart(c rune) bool {
+	switch {
+	case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		return true
+	case c >= 0xC0 && c <= 0xD6, c >= 0xD8 && c <= 0xF6, c >= 0xF8 && c <= 0x2FF:
+		return true
+	case c >= 0x370 && c <= 0x37D, c >= 0x37F && c <= 0x1FFF, c >= 0x200C && c <= 0x200D:
+		return true
+	case c >= 0x2070 && c <= 0x218F, c >= 0x2C00 && c <= 0x2FEF, c >= 0x3001 && c <= 0xD7FF:
+		return true
+	case c >= 0xF900 && c <= 0xFDCF, c >= 0xFDF0 && c <= 0xFFFD, c >= 0x10000 && c <= 0xEFFFF:
+		return true
+	}
+
+	return false
+}
+
+func isXMLNameChar(c rune) bool {
+	switch {
+	case c == '-', c == '.', c >= '0' && c <= '9', c == 0xB7:
+		return true
+	case c >= 0x300 && c <= 0x36F, c >= 0x203F && c <= 0x2040:
+		return true
+	}
+
+	return false
+}